@@ -0,0 +1,203 @@
+package rebranch
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Backup is a saved tip of a branch replaced by rebranch --done
+type Backup struct {
+	Ref    string
+	Branch string
+	Time   time.Time
+	SHA    string
+}
+
+// backupRef returns the ref a backup of branch taken at timestamp is kept in
+func backupRef(branch string, timestamp int64) string {
+	return fmt.Sprintf("%s%s/%d", BackupRefPrefix, branch, timestamp)
+}
+
+// listBackups returns the backups of branch, or of every branch when branch
+// is empty, sorted by branch and newest first
+func listBackups(git GitInterface, branch string) ([]Backup, error) {
+	refs, err := git.GetRefs(BackupRefPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var backups []Backup
+	for ref, sha := range refs {
+		// Branch names may contain slashes; the timestamp is the last part
+		name := strings.TrimPrefix(ref, BackupRefPrefix)
+		slash := strings.LastIndex(name, "/")
+		if slash < 0 {
+			continue
+		}
+		timestamp, err := strconv.ParseInt(name[slash+1:], 10, 64)
+		if err != nil {
+			continue
+		}
+		if branch != "" && name[:slash] != branch {
+			continue
+		}
+		backups = append(backups, Backup{
+			Ref:    ref,
+			Branch: name[:slash],
+			Time:   time.Unix(timestamp, 0),
+			SHA:    sha,
+		})
+	}
+
+	sort.Slice(backups, func(i, j int) bool {
+		if backups[i].Branch != backups[j].Branch {
+			return backups[i].Branch < backups[j].Branch
+		}
+		return backups[i].Time.After(backups[j].Time)
+	})
+	return backups, nil
+}
+
+// nextBackupRef returns the ref the next backup of branch is saved under
+func nextBackupRef(git GitInterface, branch string) (string, error) {
+	existing, err := listBackups(git, branch)
+	if err != nil {
+		return "", err
+	}
+
+	// Two rebranches within a second still need distinct, ordered refs
+	timestamp := time.Now().Unix()
+	if len(existing) > 0 && existing[0].Time.Unix() >= timestamp {
+		timestamp = existing[0].Time.Unix() + 1
+	}
+
+	return backupRef(branch, timestamp), nil
+}
+
+// backupLimit returns how many backups to keep per branch, from the
+// rebranch.keepBackups config. 0 keeps them all.
+func backupLimit(git GitInterface) (int, error) {
+	value, err := git.GetConfig("rebranch.keepBackups")
+	if err != nil {
+		return 0, err
+	}
+	if value == "" {
+		return DefaultKeepBackups, nil
+	}
+
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit < 0 {
+		return 0, fmt.Errorf("invalid rebranch.keepBackups '%s' (must be a number, 0 keeps every backup)", value)
+	}
+	return limit, nil
+}
+
+// pruneBackups deletes all but the newest backups of branch
+func pruneBackups(git GitInterface, branch string) error {
+	limit, err := backupLimit(git)
+	if err != nil || limit == 0 {
+		return err
+	}
+
+	backups, err := listBackups(git, branch)
+	if err != nil {
+		return err
+	}
+	for i := limit; i < len(backups); i++ {
+		if err := git.DeleteRef(backups[i].Ref, backups[i].SHA); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listBackupsRebranch prints the backups of branch, or of every branch
+func listBackupsRebranch(git GitInterface, branch string) error {
+	if err := git.IsValidRepository(); err != nil {
+		return fmt.Errorf("invalid repository: %w", err)
+	}
+
+	backups, err := listBackups(git, branch)
+	if err != nil {
+		return err
+	}
+	if len(backups) == 0 {
+		if branch != "" {
+			fmt.Printf("No backups of %s\n", branch)
+		} else {
+			fmt.Printf("No backups\n")
+		}
+		return nil
+	}
+
+	for _, backup := range backups {
+		message, err := git.GetCommitMessage(backup.SHA)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s  %s  %s %s\n", backup.Branch, backup.Time.Format("2006-01-02 15:04:05"),
+			shortSHA(backup.SHA), commitSubject(message))
+	}
+	return nil
+}
+
+// undoRebranch restores branch to its newest backup and removes that backup,
+// so repeated undos step further back
+func undoRebranch(git GitInterface, store Store, branch string) error {
+	if branch == "" {
+		current, err := git.GetCurrentBranch()
+		if err != nil {
+			return fmt.Errorf("failed to get current branch: %w", err)
+		}
+		branch = current
+	}
+
+	if err := validateUndo(branch, git, store); err != nil {
+		return err
+	}
+
+	backups, err := listBackups(git, branch)
+	if err != nil {
+		return err
+	}
+	if len(backups) == 0 {
+		return fmt.Errorf("no backups of %s\n"+
+			"\n"+
+			"Backups are saved by rebranch --done. List them with: rebranch --list-backups", branch)
+	}
+	backup := backups[0]
+
+	current, _ := git.GetCurrentBranch()
+	var oldSHA string
+	switch {
+	case current == branch:
+		// Checked out: move the working tree along with the branch
+		if oldSHA, err = git.ResolveRevision("HEAD"); err != nil {
+			return err
+		}
+		err = git.ResetHard(backup.SHA)
+	case git.BranchExists(branch):
+		if oldSHA, err = git.ResolveRevision("refs/heads/" + branch); err != nil {
+			return err
+		}
+		err = git.UpdateRef("refs/heads/"+branch, backup.SHA, oldSHA)
+	default:
+		err = git.CreateBranch(branch, backup.SHA)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to restore %s: %w", branch, err)
+	}
+
+	if err := git.DeleteRef(backup.Ref, backup.SHA); err != nil {
+		return err
+	}
+
+	fmt.Printf("Restored %s to %s (backup from %s)\n", branch, shortSHA(backup.SHA), backup.Time.Format("2006-01-02 15:04:05"))
+	if oldSHA != "" {
+		fmt.Printf("It was at %s; that commit is still in the reflog\n", shortSHA(oldSHA))
+	}
+	return nil
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"flag"
 	"fmt"
 	"os"
 
@@ -11,41 +10,20 @@ import (
 const version = "1.0.0"
 
 func main() {
-	var showHelp bool
-	var showVersion bool
-
-	flag.BoolVar(&showHelp, "help", false, "Show help information")
-	flag.BoolVar(&showHelp, "h", false, "Show help information")
-	flag.BoolVar(&showVersion, "version", false, "Show version information")
-	flag.BoolVar(&showVersion, "v", false, "Show version information")
-
-	// Parse flags but don't exit on error, we'll handle it ourselves
-	flag.CommandLine.Init(os.Args[0], flag.ContinueOnError)
-	flag.CommandLine.SetOutput(os.Stderr)
-	
-	err := flag.CommandLine.Parse(os.Args[1:])
-	if err != nil {
-		if err == flag.ErrHelp {
-			showHelp = true
-		} else {
-			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-			os.Exit(1)
+	// rebranch commands look like flags (--continue, --done, ...), so only
+	// help and version are handled here and everything else goes to RunCmd
+	args := os.Args[1:]
+	if len(args) > 0 {
+		switch args[0] {
+		case "-h", "-help", "--help":
+			printHelp()
+			return
+		case "-v", "-version", "--version":
+			fmt.Printf("rebranch version %s\n", version)
+			return
 		}
 	}
 
-	if showVersion {
-		fmt.Printf("rebranch version %s\n", version)
-		return
-	}
-
-	if showHelp {
-		printHelp()
-		return
-	}
-
-	// Get remaining arguments after flag parsing
-	args := flag.Args()
-
 	if err := rebranch.RunCmd(args, rebranch.Options{}); err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 		os.Exit(1)
@@ -57,17 +35,44 @@ func printHelp() {
 
 USAGE:
     rebranch <base-branch>    Start interactive rebranch onto base-branch
-    rebranch --continue       Continue after resolving conflicts
+    rebranch                  Start onto the inferred base (upstream, origin/HEAD,
+                              then main or master)
+    rebranch --continue       Continue after resolving conflicts or editing
+    rebranch --skip           Drop the conflicting commit (or the one whose
+                              message failed) and continue
+    rebranch --status         Show progress and the next valid commands
+    rebranch --fold-new       Add commits made on the original branch since the
+                              rebranch started to the end of the pick list
     rebranch --done           Complete rebranch and replace original branch
     rebranch --abort          Cancel rebranch and cleanup
+    rebranch --repair         Rebuild an unreadable state file from the temp branch
+    rebranch --undo [<branch>]
+                              Restore the branch as it was before the last --done
+    rebranch --list-backups [<branch>]
+                              List the backups saved by --done
 
 OPTIONS:
+    --drop-missing           Treat commits removed from the pick file as dropped
+    --exec <cmd>             Run <cmd> after each applied commit (repeatable)
+    --stack, --update-refs   Also move dependent branches whose tips are in the range
+    --onto <newbase>         Create the new branch from <newbase>; the argument then
+                             names the upstream, and only commits after it are moved
+    --dry-run                Report which commits would apply cleanly, become empty
+                             or conflict, without changing anything
+    --worktree               Apply the commits in a linked worktree under .git/rebranch/
+                             instead of switching your checkout to the new branch
+    --merges <mode>          How to handle merge commits in the range:
+                               linearize (default): drop merges, pick the merged-in commits
+                               skip: drop merges and what they brought in
+                               rebase-merges: recreate merges with label/reset/merge
     -h, --help               Show this help message
     -v, --version            Show version information
 
 DESCRIPTION:
     rebranch allows you to interactively cherry-pick commits from your current
     branch onto a new base, with conflict resolution support and safe rollback.
+    The base may be any revision: a local or remote-tracking branch, a tag or
+    a commit SHA. It is resolved once when the rebranch starts.
 
 WORKFLOW:
     1. Start: rebranch <base-branch>
@@ -79,6 +84,7 @@ WORKFLOW:
        - Edit conflicted files
        - Stage resolved files: git add <files>
        - Continue: rebranch --continue
+       - Or drop the conflicting commit: rebranch --skip
 
     3. Review and finish:
        - Inspect the rebranched commits
@@ -91,12 +97,31 @@ INTERACTIVE FILE FORMAT:
     drop ghi9012 Third commit    # Skip this commit  
     d    jkl3456 Fourth commit   # Skip (abbreviation)
 
+    Commits are applied in the order they are listed. Every commit must be
+    listed exactly once; use drop to skip one, or --drop-missing to treat
+    deleted lines as dropped.
+
+    reword, r                    # Apply and edit the commit message
+    edit, e                      # Apply and stop for amending
+    squash, s                    # Meld into previous commit, edit combined message
+    fixup, f                     # Meld into previous commit, keep previous message
+    exec, x <command>            # Run a shell command, stop if it fails
+    update-ref refs/heads/<name> # Move branch <name> here on --done
+    label <label>                # Name the current commit (--merges=rebase-merges)
+    reset <label>                # Reset the new branch to a label
+    merge -C <commit> <label>    # Recreate merge <commit> of <label>
+
 EXAMPLES:
     rebranch main               # Rebranch current branch onto main
     rebranch --continue         # Resume after conflict resolution
     rebranch --done             # Finish successful rebranch
     rebranch --abort            # Cancel and cleanup
 
+BACKUPS:
+    --done saves the old tip of the branch as refs/rebranch/backup/<branch>/<time>.
+    The newest 10 backups per branch are kept; set a different number with
+    git config rebranch.keepBackups <n> (0 keeps every backup).
+
 ENVIRONMENT:
     EDITOR                      Editor for interactive commit selection
                                (defaults to 'vi' if not set)
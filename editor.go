@@ -1,6 +1,7 @@
 package rebranch
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
@@ -43,27 +44,80 @@ func CreateInteractiveFile(commits []CommitInfo, filePath string) error {
 	lines = append(lines, "# Interactive rebranch - Edit the list of commits to apply")
 	lines = append(lines, "# Commands:")
 	lines = append(lines, "#  pick, p = apply this commit")
+	lines = append(lines, "#  reword, r = apply this commit, but edit the commit message")
+	lines = append(lines, "#  edit, e = apply this commit, but stop for amending")
+	lines = append(lines, "#  squash, s = meld into previous commit, editing the combined message")
+	lines = append(lines, "#  fixup, f = meld into previous commit, keeping the previous message")
+	lines = append(lines, "#  exec, x <command> = run command (the rest of the line) using shell")
+	lines = append(lines, "#  update-ref <ref> = move <ref> to this point on --done (delete to keep it)")
+	lines = append(lines, "#  label <label> = name the current commit")
+	lines = append(lines, "#  reset <label> = reset the new branch to a label")
+	lines = append(lines, "#  merge -C <commit> <label> = recreate a merge of <label>, reusing the")
+	lines = append(lines, "#          message of <commit>")
 	lines = append(lines, "#  drop, d = skip this commit")
 	lines = append(lines, "#")
+	lines = append(lines, "# Commits are applied in the order listed; reorder lines to reorder commits.")
+	lines = append(lines, "# Commits already merged into the base branch are pre-marked as drop.")
+	lines = append(lines, "# Merge commits can only be dropped, or recreated with merge.")
 	lines = append(lines, "# Lines starting with # are ignored.")
+
+	// Explain why a leading run of commits is pre-marked as drop
+	squashMerged := 0
+	for _, commit := range commits {
+		if commit.SquashMerged {
+			squashMerged++
+		}
+	}
+	if squashMerged > 0 {
+		lines = append(lines, "#")
+		lines = append(lines, fmt.Sprintf("# The first %d commits are pre-marked as drop: their combined changes", squashMerged))
+		lines = append(lines, "# are already present in the base branch (squash-merged parent branch).")
+	}
 	lines = append(lines, "")
 
 	// Add commits
 	for _, commit := range commits {
-		shortSHA := commit.SHA
-		if len(shortSHA) > 7 {
-			shortSHA = shortSHA[:7]
-		}
-		line := fmt.Sprintf("pick %s %s", shortSHA, commit.Message)
-		lines = append(lines, line)
+		lines = append(lines, formatPickLine(commit))
 	}
 
 	content := strings.Join(lines, "\n") + "\n"
 	return os.WriteFile(filePath, []byte(content), 0644)
 }
 
+// formatPickLine returns the pick file line for an entry
+func formatPickLine(commit CommitInfo) string {
+	switch commit.Action {
+	case "exec":
+		return "exec " + commit.Command
+	case "update-ref":
+		return "update-ref " + commit.Ref
+	case "label", "reset":
+		return commit.Action + " " + commit.Label
+	case "merge":
+		return fmt.Sprintf("merge -C %s %s # %s", shortSHA(commit.SHA), commit.Label, commitSubject(commit.Message))
+	}
+
+	action := commit.Action
+	if action == "" {
+		action = "pick"
+	}
+	line := fmt.Sprintf("%s %s %s", action, shortSHA(commit.SHA), commitSubject(commit.Message))
+	if len(commit.Parents) > 1 {
+		line += " # merge commit"
+	} else if commit.UpstreamSHA != "" {
+		line += fmt.Sprintf(" # already upstream as %s", shortSHA(commit.UpstreamSHA))
+	} else if commit.SquashMerged {
+		line += " # squash-merged upstream"
+	} else if commit.MergedIn {
+		line += " # brought in by a merge"
+	}
+	return line
+}
+
 // ParseInteractiveFile parses the edited pick file and returns selected commits
-func ParseInteractiveFile(filePath string, originalCommits []CommitInfo) ([]CommitInfo, error) {
+// in the order they are listed. Commits removed from the file are an error
+// unless dropMissing is set, in which case they are treated as dropped.
+func ParseInteractiveFile(filePath string, originalCommits []CommitInfo, dropMissing bool) ([]CommitInfo, error) {
 	data, err := os.ReadFile(filePath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read pick file: %w", err)
@@ -72,14 +126,23 @@ func ParseInteractiveFile(filePath string, originalCommits []CommitInfo) ([]Comm
 	lines := strings.Split(string(data), "\n")
 	var selectedCommits []CommitInfo
 	commitMap := make(map[string]CommitInfo)
+	listedOn := make(map[string]int)
+
+	updateRefs := make(map[string]CommitInfo)
+	refListedOn := make(map[string]int)
+
+	// onto is where the new branch starts; other labels need a label line first
+	definedLabels := map[string]bool{"onto": true}
 
 	// Create map for quick lookup
 	for _, commit := range originalCommits {
-		shortSHA := commit.SHA
-		if len(shortSHA) > 7 {
-			shortSHA = shortSHA[:7]
+		switch commit.Action {
+		case "exec", "label", "reset":
+		case "update-ref":
+			updateRefs[commit.Ref] = commit
+		default:
+			commitMap[shortSHA(commit.SHA)] = commit
 		}
-		commitMap[shortSHA] = commit
 	}
 
 	lineNum := 0
@@ -99,33 +162,142 @@ func ParseInteractiveFile(filePath string, originalCommits []CommitInfo) ([]Comm
 		}
 
 		action := parts[0]
-		shortSHA := parts[1]
+		commitSHA := parts[1]
+
+		// exec takes the rest of the line as a shell command
+		if action == "exec" || action == "x" {
+			command := strings.TrimSpace(strings.TrimPrefix(line, action))
+			selectedCommits = append(selectedCommits, CommitInfo{Action: "exec", Command: command})
+			continue
+		}
+
+		// update-ref may only name the stacked branches that were offered
+		if action == "update-ref" {
+			updateRef, exists := updateRefs[commitSHA]
+			if !exists {
+				return nil, fmt.Errorf("unknown ref %s on line %d", commitSHA, lineNum)
+			}
+			if firstLine, listed := refListedOn[commitSHA]; listed {
+				return nil, fmt.Errorf("duplicate ref %s on line %d (already listed on line %d)", commitSHA, lineNum, firstLine)
+			}
+			refListedOn[commitSHA] = lineNum
+			selectedCommits = append(selectedCommits, updateRef)
+			continue
+		}
+
+		// label and reset take a single name; anything after it is a comment
+		if action == "label" || action == "reset" {
+			if len(parts) > 2 && !strings.HasPrefix(parts[2], "#") {
+				return nil, fmt.Errorf("invalid line %d: %s takes a single label", lineNum, action)
+			}
+			if action == "label" {
+				definedLabels[parts[1]] = true
+			} else if err := checkLabelDefined(parts[1], lineNum, definedLabels, originalCommits); err != nil {
+				return nil, err
+			}
+			selectedCommits = append(selectedCommits, CommitInfo{Action: action, Label: parts[1]})
+			continue
+		}
+
+		// merge -C <commit> <label>... recreates one of the offered merges
+		if action == "merge" {
+			if len(parts) < 4 || parts[1] != "-C" || strings.HasPrefix(parts[3], "#") {
+				return nil, fmt.Errorf("invalid line %d: expected merge -C <commit> <label>", lineNum)
+			}
+			commitSHA = parts[2]
+			originalCommit, exists := commitMap[commitSHA]
+			if !exists || originalCommit.Action != "merge" {
+				return nil, fmt.Errorf("unknown merge commit %s on line %d", commitSHA, lineNum)
+			}
+			if firstLine, listed := listedOn[commitSHA]; listed {
+				return nil, fmt.Errorf("duplicate commit %s on line %d (already listed on line %d)", commitSHA, lineNum, firstLine)
+			}
+			listedOn[commitSHA] = lineNum
+
+			var labels []string
+			for _, label := range parts[3:] {
+				if strings.HasPrefix(label, "#") {
+					break
+				}
+				if err := checkLabelDefined(label, lineNum, definedLabels, originalCommits); err != nil {
+					return nil, err
+				}
+				labels = append(labels, label)
+			}
+			commit := originalCommit
+			commit.Label = strings.Join(labels, " ")
+			selectedCommits = append(selectedCommits, commit)
+			continue
+		}
 
 		// Normalize action (support abbreviations)
 		switch action {
 		case "pick", "p":
 			action = "pick"
+		case "reword", "r":
+			action = "reword"
+		case "edit", "e":
+			action = "edit"
+		case "squash", "s":
+			action = "squash"
+		case "fixup", "f":
+			action = "fixup"
 		case "drop", "d":
 			action = "drop"
 		default:
-			return nil, fmt.Errorf("invalid action '%s' on line %d (must be 'pick', 'p', 'drop', or 'd')", action, lineNum)
+			return nil, fmt.Errorf("invalid action '%s' on line %d (must be pick, reword, edit, squash, fixup, exec, update-ref, label, reset, merge or drop)", action, lineNum)
+		}
+
+		// squash and fixup meld into the previously applied commit
+		if (action == "squash" || action == "fixup") && countAppliedCommits(selectedCommits) == 0 {
+			return nil, fmt.Errorf("cannot %s on line %d without a previous commit", action, lineNum)
 		}
 
 		// Find original commit
-		originalCommit, exists := commitMap[shortSHA]
+		originalCommit, exists := commitMap[commitSHA]
 		if !exists {
-			return nil, fmt.Errorf("unknown commit %s on line %d", shortSHA, lineNum)
+			return nil, fmt.Errorf("unknown commit %s on line %d", commitSHA, lineNum)
 		}
 
-		// Add to selected commits with updated action
-		commit := CommitInfo{
-			SHA:     originalCommit.SHA,
-			Message: originalCommit.Message,
-			Action:  action,
+		// Merge commits cannot be cherry-picked
+		if len(originalCommit.Parents) > 1 && action != "drop" {
+			return nil, fmt.Errorf("cannot %s merge commit %s on line %d\n"+
+				"\n"+
+				"Drop it, or rerun with --merges=rebase-merges to recreate it", action, commitSHA, lineNum)
+		}
+
+		// Each commit may only be listed once
+		if firstLine, listed := listedOn[commitSHA]; listed {
+			return nil, fmt.Errorf("duplicate commit %s on line %d (already listed on line %d)", commitSHA, lineNum, firstLine)
 		}
+		listedOn[commitSHA] = lineNum
+
+		// Add to selected commits with updated action
+		commit := originalCommit
+		commit.Action = action
 		selectedCommits = append(selectedCommits, commit)
 	}
 
+	// Removing a line is easy to do by accident, so require an explicit drop
+	if !dropMissing {
+		var missing []string
+		for _, commit := range originalCommits {
+			switch commit.Action {
+			case "drop", "exec", "update-ref", "label", "reset":
+				continue
+			}
+			if _, listed := listedOn[shortSHA(commit.SHA)]; !listed {
+				missing = append(missing, shortSHA(commit.SHA))
+			}
+		}
+		if len(missing) > 0 {
+			return nil, fmt.Errorf("commits missing from the pick file: %s\n"+
+				"\n"+
+				"Use 'drop' to skip a commit, or rerun with --drop-missing to treat\n"+
+				"removed lines as dropped", strings.Join(missing, ", "))
+		}
+	}
+
 	if len(selectedCommits) == 0 {
 		return nil, fmt.Errorf("no commits selected (all lines were comments or invalid)")
 	}
@@ -133,7 +305,80 @@ func ParseInteractiveFile(filePath string, originalCommits []CommitInfo) ([]Comm
 	return selectedCommits, nil
 }
 
+// EditCommitMessage writes message to filePath, opens it in the editor and
+// returns the edited message. Comment lines are stripped when committing, and
+// a message with nothing else is an error.
+func EditCommitMessage(editor EditorInterface, filePath, message string) (string, error) {
+	content := message + "\n" +
+		"\n" +
+		"# Please enter the commit message for your changes. Lines starting\n" +
+		"# with '#' will be ignored, and an empty message aborts the commit.\n"
+	if err := os.WriteFile(filePath, []byte(content), 0644); err != nil {
+		return "", fmt.Errorf("failed to write message file: %w", err)
+	}
+
+	if err := editor.LaunchEditor(filePath); err != nil {
+		return "", fmt.Errorf("failed to launch editor: %w", err)
+	}
+
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read message file: %w", err)
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(line) != "" && !strings.HasPrefix(line, "#") {
+			return string(data), nil
+		}
+	}
+	return "", errors.New("aborting commit due to empty commit message")
+}
+
 // GetPickFilePath returns the path to the interactive pick file
-func GetPickFilePath(repoPath string) string {
-	return filepath.Join(repoPath, ".git", PickFileName)
-}
\ No newline at end of file
+func GetPickFilePath(gitDir string) string {
+	return filepath.Join(gitDir, PickFileName)
+}
+
+// GetMessageFilePath returns the path to the commit message file
+func GetMessageFilePath(gitDir string) string {
+	return filepath.Join(gitDir, MessageFileName)
+}
+
+// shortSHA abbreviates a commit SHA to 7 characters
+func shortSHA(sha string) string {
+	if len(sha) > 7 {
+		return sha[:7]
+	}
+	return sha
+}
+
+// inRangeCommit reports whether name abbreviates one of the commits being
+// rebranched, which only a label line can give a new position
+func inRangeCommit(name string, commits []CommitInfo) bool {
+	if len(name) < 4 {
+		return false
+	}
+	for _, commit := range commits {
+		if commit.SHA != "" && strings.HasPrefix(commit.SHA, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkLabelDefined rejects a reset or merge of an in-range commit that no
+// earlier label line names
+func checkLabelDefined(label string, lineNum int, defined map[string]bool, commits []CommitInfo) error {
+	if defined[label] || !inRangeCommit(label, commits) {
+		return nil
+	}
+	return fmt.Errorf("undefined label %s on line %d\n"+
+		"\n"+
+		"Add 'label %s' after the line it should point to", label, lineNum, label)
+}
+
+// commitSubject returns the first line of a commit message
+func commitSubject(message string) string {
+	subject, _, _ := strings.Cut(message, "\n")
+	return strings.TrimSpace(subject)
+}
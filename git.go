@@ -1,6 +1,9 @@
 package rebranch
 
 import (
+	"bufio"
+	"bytes"
+	"container/heap"
 	"errors"
 	"fmt"
 	"os"
@@ -8,32 +11,76 @@ import (
 	"path/filepath"
 	"strings"
 
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/osfs"
 	"github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/plumbing"
-	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/cache"
+	commitgraphfmt "github.com/go-git/go-git/v5/plumbing/format/commitgraph/v2"
+	"github.com/go-git/go-git/v5/plumbing/object/commitgraph"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+	"github.com/go-git/go-git/v5/storage/filesystem/dotgit"
 )
 
 // GitInterface abstracts Git operations
 type GitInterface interface {
 	GetCurrentBranch() (string, error)
+	GetPreviousBranch() (string, error)
 	BranchExists(branch string) bool
+	GetBranchTips() (map[string]string, error)
+	ResolveRevision(rev string) (string, error)
+	FindBaseBranch(branch string) (string, error)
+	IsAncestor(ancestor, rev string) (bool, error)
 	GetCommitsBetween(base, head string) ([]CommitInfo, error)
+	MarkMergedCommits(base, head string, commits []CommitInfo) error
+	HasChangesApplied(base, from, to string) (bool, error)
 	CreateBranch(name, base string) error
 	CheckoutBranch(name string) error
+	AddWorktree(path, branch string) error
+	RemoveWorktree(path string) error
 	CherryPick(sha string) error
+	SimulateCherryPick(onto, sha string) (string, []string, error)
+	Merge(message string, revs ...string) error
+	ResetHard(rev string) error
+	UpdateRef(ref, newSHA, oldSHA string) error
+	UpdateRefs(message string, updates []RefUpdate) error
+	SetHeadBranch(name string) error
+	DeleteRef(ref, oldSHA string) error
+	GetRefs(prefix string) (map[string]string, error)
+	GetConfig(key string) (string, error)
+	GetCommitMessage(rev string) (string, error)
+	AmendCommit(message string) error
+	SquashHead(message string) error
+	FixupHead() error
+	Exec(command string) error
 	DeleteBranch(name string) error
 	RenameBranch(oldName, newName string) error
 	HasUncommittedChanges() (bool, error)
 	IsCleanWorkingDirectory() (bool, error)
 	HasOngoingOperation() (bool, string, error)
+	PendingCommit() string
+	CommitPending() error
+	UnmergedPaths() ([]string, error)
+	UnstagedPaths() ([]string, error)
 	IsValidRepository() error
 	GetRepoPath() string
+	GetGitDir() string
+	GetCommonDir() string
+}
+
+// RefUpdate is one ref change of an UpdateRefs transaction
+type RefUpdate struct {
+	Ref    string
+	NewSHA string
+	OldSHA string // Expected current value; empty if the ref must not exist yet
 }
 
 // Git implements GitInterface using hybrid go-git + exec.Command approach
 type Git struct {
-	repo     *git.Repository
-	repoPath string
+	repo      *git.Repository
+	repoPath  string
+	gitDir    string // Per-worktree git directory (HEAD, index, state files)
+	commonDir string // Git directory shared by all worktrees (objects, refs)
 }
 
 // NewGit creates a new Git instance
@@ -44,30 +91,61 @@ func NewGit() (GitInterface, error) {
 		return nil, fmt.Errorf("failed to get current directory: %w", err)
 	}
 
-	// Open repository with go-git
-	repo, err := git.PlainOpen(cwd)
+	return NewGitInPath(cwd)
+}
+
+// NewGitInPath creates a new Git instance for the repository containing path.
+// Commands run from the top level of its working tree, whichever
+// subdirectory path is.
+func NewGitInPath(path string) (GitInterface, error) {
+	topLevel, gitDir, commonDir, err := resolveRepository(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open git repository at %s: %w", path, err)
+	}
+
+	// Open repository with go-git; a linked worktree reads the objects and
+	// refs of the common directory
+	var dotGit billy.Filesystem = osfs.New(gitDir)
+	if commonDir != gitDir {
+		dotGit = dotgit.NewRepositoryFilesystem(dotGit, osfs.New(commonDir))
+	}
+	repo, err := git.Open(filesystem.NewStorage(dotGit, cache.NewObjectLRUDefault()), osfs.New(topLevel))
 	if err != nil {
-		return nil, fmt.Errorf("failed to open git repository: %w", err)
+		return nil, fmt.Errorf("failed to open git repository at %s: %w", path, err)
 	}
 
 	return &Git{
-		repo:     repo,
-		repoPath: cwd,
+		repo:      repo,
+		repoPath:  topLevel,
+		gitDir:    gitDir,
+		commonDir: commonDir,
 	}, nil
 }
 
-// NewGitInPath creates a new Git instance for a specific path
-func NewGitInPath(path string) (GitInterface, error) {
-	// Open repository with go-git
-	repo, err := git.PlainOpen(path)
+// resolveRepository returns the top level of the working tree containing
+// path, its git directory and the common directory shared by its worktrees.
+// git itself discovers them, so parent directories, GIT_DIR, GIT_WORK_TREE,
+// GIT_COMMON_DIR and the .git file of a linked worktree or submodule are all
+// honoured.
+func resolveRepository(path string) (string, string, string, error) {
+	cmd := exec.Command("git", "rev-parse", "--show-toplevel", "--absolute-git-dir", "--git-common-dir")
+	cmd.Dir = path
+	output, err := cmd.Output()
 	if err != nil {
-		return nil, fmt.Errorf("failed to open git repository at %s: %w", path, err)
+		return "", "", "", errors.New("not a git repository (or not inside its working tree)")
 	}
 
-	return &Git{
-		repo:     repo,
-		repoPath: path,
-	}, nil
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	if len(lines) != 3 {
+		return "", "", "", fmt.Errorf("unexpected git rev-parse output: %q", output)
+	}
+
+	// The common directory is printed relative to path unless it is elsewhere
+	topLevel, gitDir, commonDir := lines[0], lines[1], lines[2]
+	if !filepath.IsAbs(commonDir) {
+		commonDir = filepath.Join(path, commonDir)
+	}
+	return topLevel, gitDir, filepath.Clean(commonDir), nil
 }
 
 func (g *Git) GetCurrentBranch() (string, error) {
@@ -83,88 +161,546 @@ func (g *Git) GetCurrentBranch() (string, error) {
 	return head.Name().Short(), nil
 }
 
+// GetPreviousBranch returns the branch that was checked out before the
+// current one, like git checkout -
+func (g *Git) GetPreviousBranch() (string, error) {
+	cmd := exec.Command("git", "rev-parse", "--abbrev-ref", "@{-1}")
+	cmd.Dir = g.repoPath
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to find the previous branch: %w", err)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
 func (g *Git) BranchExists(branch string) bool {
 	_, err := g.repo.Reference(plumbing.NewBranchReferenceName(branch), true)
 	return err == nil
 }
 
-func (g *Git) GetCommitsBetween(base, head string) ([]CommitInfo, error) {
-	// Get references for both branches
-	baseRef, err := g.repo.Reference(plumbing.NewBranchReferenceName(base), true)
+// GetBranchTips returns the commit SHA of every local branch, keyed by name
+func (g *Git) GetBranchTips() (map[string]string, error) {
+	branches, err := g.repo.Branches()
 	if err != nil {
-		return nil, fmt.Errorf("base branch %s not found: %w", base, err)
+		return nil, fmt.Errorf("failed to list branches: %w", err)
 	}
+	defer branches.Close()
+
+	tips := make(map[string]string)
+	err = branches.ForEach(func(ref *plumbing.Reference) error {
+		tips[ref.Name().Short()] = ref.Hash().String()
+		return nil
+	})
+
+	return tips, err
+}
 
-	headRef, err := g.repo.Reference(plumbing.NewBranchReferenceName(head), true)
+// ResolveRevision resolves a revision to a commit SHA
+func (g *Git) ResolveRevision(rev string) (string, error) {
+	hash, err := g.repo.ResolveRevision(plumbing.Revision(rev))
 	if err != nil {
-		return nil, fmt.Errorf("head branch %s not found: %w", head, err)
+		return "", fmt.Errorf("failed to resolve %s: %w", rev, err)
 	}
+	return hash.String(), nil
+}
 
-	// Get commit objects
-	baseCommit, err := g.repo.CommitObject(baseRef.Hash())
+// FindBaseBranch guesses the base to rebranch branch onto: its configured
+// upstream, then the default branch origin/HEAD points at, then main or master
+func (g *Git) FindBaseBranch(branch string) (string, error) {
+	cfg, err := g.repo.Config()
 	if err != nil {
-		return nil, fmt.Errorf("failed to get base commit: %w", err)
+		return "", fmt.Errorf("failed to read git config: %w", err)
+	}
+
+	var candidates []string
+
+	// Configured upstream (branch.<name>.remote and branch.<name>.merge),
+	// unless it is just the pushed copy of the same branch
+	if branchCfg, ok := cfg.Branches[branch]; ok && branchCfg.Merge != "" && branchCfg.Merge.Short() != branch {
+		upstream := branchCfg.Merge.Short()
+		if branchCfg.Remote != "" && branchCfg.Remote != "." {
+			upstream = branchCfg.Remote + "/" + upstream
+		}
+		candidates = append(candidates, upstream)
 	}
 
-	headCommit, err := g.repo.CommitObject(headRef.Hash())
+	// The remote's default branch
+	if ref, err := g.repo.Reference(plumbing.NewRemoteHEADReferenceName("origin"), false); err == nil && ref.Type() == plumbing.SymbolicReference {
+		candidates = append(candidates, ref.Target().Short())
+	}
+
+	candidates = append(candidates, "main", "master")
+
+	for _, candidate := range candidates {
+		if _, err := g.repo.ResolveRevision(plumbing.Revision(candidate)); err == nil {
+			return candidate, nil
+		}
+	}
+
+	return "", errors.New("no upstream, origin/HEAD, main or master branch found")
+}
+
+// IsAncestor reports whether ancestor is reachable from rev
+func (g *Git) IsAncestor(ancestor, rev string) (bool, error) {
+	cmd := exec.Command("git", "merge-base", "--is-ancestor", ancestor, rev)
+	cmd.Dir = g.repoPath
+	if err := cmd.Run(); err != nil {
+		// Exit code 1 means it is not an ancestor
+		if exitError, ok := err.(*exec.ExitError); ok && exitError.ExitCode() == 1 {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to check whether %s is an ancestor of %s: %w", ancestor, rev, err)
+	}
+	return true, nil
+}
+
+// GetCommitsBetween returns the commits reachable from head but not from base,
+// oldest first. Both may be any revision: branches, remote-tracking branches,
+// tags or SHAs.
+func (g *Git) GetCommitsBetween(base, head string) ([]CommitInfo, error) {
+	// Resolve both revisions to commits
+	baseHash, err := g.repo.ResolveRevision(plumbing.Revision(base))
 	if err != nil {
-		return nil, fmt.Errorf("failed to get head commit: %w", err)
+		return nil, fmt.Errorf("base revision %s not found: %w", base, err)
+	}
+
+	headHash, err := g.repo.ResolveRevision(plumbing.Revision(head))
+	if err != nil {
+		return nil, fmt.Errorf("head revision %s not found: %w", head, err)
 	}
 
 	// If base and head are the same, return empty list
-	if baseCommit.Hash == headCommit.Hash {
+	if *baseHash == *headHash {
 		return []CommitInfo{}, nil
 	}
 
-	// Get commits from head to base (exclusive of base)
-	commits := []CommitInfo{}
-	commitIter, err := g.repo.Log(&git.LogOptions{
-		From: headCommit.Hash,
-	})
+	nodes, err := g.walkRange(*baseHash, *headHash)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get commit log: %w", err)
+		return nil, fmt.Errorf("failed to walk %s..%s: %w", base, head, err)
 	}
-	defer commitIter.Close()
 
-	err = commitIter.ForEach(func(commit *object.Commit) error {
-		// Stop when we reach the base commit
-		if commit.Hash == baseCommit.Hash {
-			return nil
+	commits := make([]CommitInfo, 0, len(nodes))
+	for _, node := range nodes {
+		commit, err := node.Commit()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get commit %s: %w", node.ID(), err)
+		}
+		var parents []string
+		for _, parent := range commit.ParentHashes {
+			parents = append(parents, parent.String())
 		}
+		commits = append(commits, CommitInfo{
+			SHA:     commit.Hash.String(),
+			Message: strings.TrimSpace(commit.Message),
+			Action:  "pick",
+			Parents: parents,
+		})
+	}
+
+	return commits, nil
+}
+
+// Flags tracked for each commit during walkRange
+const (
+	walkSeen          = 1 << iota // Queued at least once
+	walkParsed                    // Popped and its parents queued
+	walkUninteresting             // Reachable from the excluded side
+)
+
+// walkSlop is how many extra commits walkRange pops once only excluded
+// commits remain queued, to tolerate committer dates that go backwards
+const walkSlop = 5
+
+// walkRange returns the commits reachable from head but not from base,
+// parents before children. Like git's limit_list it pops commits newest
+// first and stops as soon as every queued commit is reachable from base, so
+// only the history down to the merge-base is visited rather than all of it.
+func (g *Git) walkRange(base, head plumbing.Hash) ([]commitgraph.CommitNode, error) {
+	index, closeIndex := g.commitNodeIndex()
+	defer closeIndex()
+
+	flags := make(map[plumbing.Hash]uint8)
+	parents := make(map[plumbing.Hash][]plumbing.Hash)
+	queue := &commitNodeQueue{}
+
+	// markUninteresting flags hash and every ancestor already walked past
+	markUninteresting := func(hash plumbing.Hash) {
+		pending := []plumbing.Hash{hash}
+		for len(pending) > 0 {
+			current := pending[len(pending)-1]
+			pending = pending[:len(pending)-1]
+			if flags[current]&walkUninteresting != 0 {
+				continue
+			}
+			flags[current] |= walkUninteresting
+			if flags[current]&walkParsed != 0 {
+				pending = append(pending, parents[current]...)
+			}
+		}
+	}
 
-		// Check if this commit is reachable from base
-		isAncestor, err := g.isAncestor(baseCommit.Hash, commit.Hash)
+	push := func(hash plumbing.Hash, uninteresting bool) error {
+		if flags[hash]&walkSeen != 0 {
+			if uninteresting {
+				markUninteresting(hash)
+			}
+			return nil
+		}
+		node, err := index.Get(hash)
 		if err != nil {
 			return err
 		}
+		flags[hash] |= walkSeen
+		if uninteresting {
+			flags[hash] |= walkUninteresting
+		}
+		heap.Push(queue, node)
+		return nil
+	}
+
+	if err := push(base, true); err != nil {
+		return nil, err
+	}
+	if err := push(head, false); err != nil {
+		return nil, err
+	}
+
+	var walked []commitgraph.CommitNode
+	slop := walkSlop
+	for queue.Len() > 0 {
+		node := heap.Pop(queue).(commitgraph.CommitNode)
+		hash := node.ID()
+		flags[hash] |= walkParsed
+		parents[hash] = node.ParentHashes()
+
+		uninteresting := flags[hash]&walkUninteresting != 0
+		for _, parent := range parents[hash] {
+			if err := push(parent, uninteresting); err != nil {
+				return nil, err
+			}
+		}
+		if !uninteresting {
+			walked = append(walked, node)
+		}
+
+		// Keep going while something queued is newer or still wanted
+		if queue.Len() == 0 {
+			break
+		}
+		if !node.CommitTime().After(queue.nodes[0].CommitTime()) || queue.hasInteresting(flags) {
+			slop = walkSlop
+		} else if slop--; slop == 0 {
+			break
+		}
+	}
 
-		// Only include commits that are NOT ancestors of base
-		// (i.e., commits that are unique to the head branch)
-		if !isAncestor {
-			// Prepend to maintain chronological order (oldest first)
-			commits = append([]CommitInfo{{
-				SHA:     commit.Hash.String(),
-				Message: strings.TrimSpace(commit.Message),
-				Action:  "pick",
-			}}, commits...)
+	// Commits walked before their base-side descendant was found are excluded now
+	inRange := make(map[plumbing.Hash]commitgraph.CommitNode, len(walked))
+	for _, node := range walked {
+		if flags[node.ID()]&walkUninteresting == 0 {
+			inRange[node.ID()] = node
 		}
+	}
 
+	// Order parents before children, otherwise oldest first
+	sorted := make([]commitgraph.CommitNode, 0, len(inRange))
+	visited := make(map[plumbing.Hash]bool, len(inRange))
+	var visit func(node commitgraph.CommitNode)
+	visit = func(node commitgraph.CommitNode) {
+		if visited[node.ID()] {
+			return
+		}
+		visited[node.ID()] = true
+		for _, parent := range parents[node.ID()] {
+			if parentNode, ok := inRange[parent]; ok {
+				visit(parentNode)
+			}
+		}
+		sorted = append(sorted, node)
+	}
+	for i := len(walked) - 1; i >= 0; i-- {
+		if _, ok := inRange[walked[i].ID()]; ok {
+			visit(walked[i])
+		}
+	}
+
+	return sorted, nil
+}
+
+// commitNodeIndex returns an index backed by the commit-graph file when the
+// repository has one, falling back to reading commit objects
+func (g *Git) commitNodeIndex() (commitgraph.CommitNodeIndex, func()) {
+	if storage, ok := g.repo.Storer.(*filesystem.Storage); ok {
+		if graph, err := commitgraphfmt.OpenChainOrFileIndex(storage.Filesystem()); err == nil {
+			return commitgraph.NewGraphCommitNodeIndex(graph, g.repo.Storer), func() { graph.Close() }
+		}
+	}
+	return commitgraph.NewObjectCommitNodeIndex(g.repo.Storer), func() {}
+}
+
+// commitNodeQueue is a max-heap of commit nodes ordered by committer date
+type commitNodeQueue struct {
+	nodes []commitgraph.CommitNode
+}
+
+func (q *commitNodeQueue) Len() int {
+	return len(q.nodes)
+}
+
+func (q *commitNodeQueue) Less(i, j int) bool {
+	return q.nodes[i].CommitTime().After(q.nodes[j].CommitTime())
+}
+
+func (q *commitNodeQueue) Swap(i, j int) {
+	q.nodes[i], q.nodes[j] = q.nodes[j], q.nodes[i]
+}
+
+func (q *commitNodeQueue) Push(x any) {
+	q.nodes = append(q.nodes, x.(commitgraph.CommitNode))
+}
+
+func (q *commitNodeQueue) Pop() any {
+	last := q.nodes[len(q.nodes)-1]
+	q.nodes = q.nodes[:len(q.nodes)-1]
+	return last
+}
+
+// hasInteresting reports whether any queued commit is not reachable from base
+func (q *commitNodeQueue) hasInteresting(flags map[plumbing.Hash]uint8) bool {
+	for _, node := range q.nodes {
+		if flags[node.ID()]&walkUninteresting == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// MarkMergedCommits marks commits whose patch-id matches a commit on base that
+// is not reachable from head as "drop". This catches commits that were
+// rewritten upstream (e.g. by a merge bot) and therefore have a new SHA.
+func (g *Git) MarkMergedCommits(base, head string, commits []CommitInfo) error {
+	if len(commits) == 0 {
 		return nil
-	})
+	}
+
+	upstream, err := g.patchIDs(head + ".." + base)
+	if err != nil {
+		return fmt.Errorf("failed to compute patch-ids for %s: %w", base, err)
+	}
+	if len(upstream) == 0 {
+		return nil
+	}
+
+	// Index upstream commits by patch-id
+	upstreamByPatchID := make(map[string]string, len(upstream))
+	for sha, patchID := range upstream {
+		upstreamByPatchID[patchID] = sha
+	}
+
+	source, err := g.patchIDs(base + ".." + head)
+	if err != nil {
+		return fmt.Errorf("failed to compute patch-ids for %s: %w", head, err)
+	}
+
+	for i := range commits {
+		patchID, ok := source[commits[i].SHA]
+		if !ok {
+			// Merges and empty commits have no patch-id
+			continue
+		}
+		if upstreamSHA, ok := upstreamByPatchID[patchID]; ok {
+			commits[i].Action = "drop"
+			commits[i].UpstreamSHA = upstreamSHA
+		}
+	}
+
+	return nil
+}
+
+// patchIDs returns the stable patch-id of every non-merge commit in revRange, keyed by commit SHA
+func (g *Git) patchIDs(revRange string) (map[string]string, error) {
+	// Use git commands since go-git has no patch-id support
+	logCmd := exec.Command("git", "log", "--no-merges", "--no-color", "--no-ext-diff", "-p", "--format=%H", revRange)
+	logCmd.Dir = g.repoPath
+	patches, err := logCmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read patches for %s: %w", revRange, err)
+	}
+
+	patchIDCmd := exec.Command("git", "patch-id", "--stable")
+	patchIDCmd.Dir = g.repoPath
+	patchIDCmd.Stdin = bytes.NewReader(patches)
+	output, err := patchIDCmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to compute patch-ids: %w", err)
+	}
+
+	// Each output line is "<patch-id> <commit-sha>"
+	ids := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 {
+			ids[fields[1]] = fields[0]
+		}
+	}
+
+	return ids, scanner.Err()
+}
+
+// HasChangesApplied reports whether the combined changes between from and to
+// are already present in base, e.g. because they were squash-merged
+func (g *Git) HasChangesApplied(base, from, to string) (bool, error) {
+	baseTree, err := g.revParse(base + "^{tree}")
+	if err != nil {
+		return false, err
+	}
+
+	// Replay from..to onto base; if nothing changes, base already has it
+	mergedTree, conflicts, err := g.mergeTrees(from, base, to)
+	if err != nil {
+		return false, err
+	}
+
+	return len(conflicts) == 0 && mergedTree == baseTree, nil
+}
+
+// SimulateCherryPick cherry-picks sha onto the commit onto in memory. It
+// returns the resulting dangling commit, which is onto itself when the pick
+// would be empty, or the conflicted paths. No refs, index or working tree are touched.
+func (g *Git) SimulateCherryPick(onto, sha string) (string, []string, error) {
+	ontoTree, err := g.revParse(onto + "^{tree}")
+	if err != nil {
+		return "", nil, err
+	}
 
-	return commits, err
+	// A root commit adds everything in it, as if its parent were empty
+	parent := sha + "^"
+	if _, err := g.revParse(parent); err != nil {
+		if parent, err = g.emptyTree(); err != nil {
+			return "", nil, err
+		}
+	}
+
+	mergedTree, conflicts, err := g.mergeTrees(parent, onto, sha)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(conflicts) > 0 {
+		return "", conflicts, nil
+	}
+	if mergedTree == ontoTree {
+		return onto, nil, nil
+	}
+
+	commit, err := g.commitTree(mergedTree, onto)
+	if err != nil {
+		return "", nil, err
+	}
+	return commit, nil, nil
 }
 
+// mergeTrees performs an in-memory three-way merge and returns the resulting
+// tree and any conflicted paths. No refs, index or working tree are touched.
+func (g *Git) mergeTrees(base, ours, theirs string) (string, []string, error) {
+	// git merge-tree computes the merge base itself, so graft both sides onto
+	// a synthetic root commit holding the base tree
+	root, err := g.commitTree(base)
+	if err != nil {
+		return "", nil, err
+	}
+	oursCommit, err := g.commitTree(ours, root)
+	if err != nil {
+		return "", nil, err
+	}
+	theirsCommit, err := g.commitTree(theirs, root)
+	if err != nil {
+		return "", nil, err
+	}
+
+	cmd := exec.Command("git", "merge-tree", "--write-tree", "--name-only", "--no-messages", oursCommit, theirsCommit)
+	cmd.Dir = g.repoPath
+	output, err := cmd.Output()
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	if err != nil {
+		// Exit code 1 means the merge has conflicts
+		if exitError, ok := err.(*exec.ExitError); ok && exitError.ExitCode() == 1 {
+			return lines[0], uniqueLines(lines[1:]), nil
+		}
+		return "", nil, fmt.Errorf("failed to merge trees: %w", err)
+	}
+
+	return lines[0], nil, nil
+}
+
+// commitTree creates a dangling commit for the tree of treeish with the given parents
+func (g *Git) commitTree(treeish string, parents ...string) (string, error) {
+	args := []string{"commit-tree", treeish + "^{tree}", "-m", "rebranch"}
+	for _, parent := range parents {
+		args = append(args, "-p", parent)
+	}
+
+	cmd := exec.Command("git", args...)
+	cmd.Dir = g.repoPath
+	// Synthetic commits must not depend on the user's identity being configured
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=rebranch", "GIT_AUTHOR_EMAIL=rebranch@localhost",
+		"GIT_COMMITTER_NAME=rebranch", "GIT_COMMITTER_EMAIL=rebranch@localhost")
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to create commit for %s: %w", treeish, err)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// emptyTree returns the SHA of the empty tree, writing it if needed
+func (g *Git) emptyTree() (string, error) {
+	cmd := exec.Command("git", "mktree")
+	cmd.Dir = g.repoPath
+	cmd.Stdin = strings.NewReader("")
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to write empty tree: %w", err)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// revParse resolves rev to an object SHA
+func (g *Git) revParse(rev string) (string, error) {
+	cmd := exec.Command("git", "rev-parse", "--verify", "--quiet", rev)
+	cmd.Dir = g.repoPath
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s: %w", rev, err)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// uniqueLines returns the non-empty lines in order with duplicates removed
+func uniqueLines(lines []string) []string {
+	seen := make(map[string]bool)
+	var unique []string
+	for _, line := range lines {
+		if line == "" || seen[line] {
+			continue
+		}
+		seen[line] = true
+		unique = append(unique, line)
+	}
+	return unique
+}
+
+// CreateBranch creates branch name pointing at the commit base resolves to
 func (g *Git) CreateBranch(name, base string) error {
-	// Get the base reference
-	baseRef, err := g.repo.Reference(plumbing.NewBranchReferenceName(base), true)
+	// Resolve the base revision
+	baseHash, err := g.repo.ResolveRevision(plumbing.Revision(base))
 	if err != nil {
-		return fmt.Errorf("base branch %s not found: %w", base, err)
+		return fmt.Errorf("base revision %s not found: %w", base, err)
 	}
 
 	// Create new branch reference
 	branchRef := plumbing.NewBranchReferenceName(name)
-	ref := plumbing.NewHashReference(branchRef, baseRef.Hash())
+	ref := plumbing.NewHashReference(branchRef, *baseHash)
 
 	return g.repo.Storer.SetReference(ref)
 }
@@ -180,6 +716,34 @@ func (g *Git) CheckoutBranch(name string) error {
 	return nil
 }
 
+// AddWorktree checks out branch in a new linked worktree at path
+func (g *Git) AddWorktree(path, branch string) error {
+	cmd := exec.Command("git", "worktree", "add", "--quiet", path, branch)
+	cmd.Dir = g.repoPath
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to add worktree %s: %w\nOutput: %s", path, err, string(output))
+	}
+	return nil
+}
+
+// RemoveWorktree removes the linked worktree at path, discarding any changes
+// in it. A worktree that is already gone is only pruned.
+func (g *Git) RemoveWorktree(path string) error {
+	args := []string{"worktree", "remove", "--force", path}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		args = []string{"worktree", "prune"}
+	}
+
+	cmd := exec.Command("git", args...)
+	cmd.Dir = g.repoPath
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to remove worktree %s: %w\nOutput: %s", path, err, string(output))
+	}
+	return nil
+}
+
 func (g *Git) CherryPick(sha string) error {
 	// Use git command for cherry-pick since go-git doesn't support it
 	cmd := exec.Command("git", "cherry-pick", sha)
@@ -195,6 +759,212 @@ func (g *Git) CherryPick(sha string) error {
 	return nil
 }
 
+// Merge creates a merge commit of HEAD and revs with the given message
+func (g *Git) Merge(message string, revs ...string) error {
+	args := append([]string{"merge", "--no-ff", "--no-edit", "-m", message}, revs...)
+	cmd := exec.Command("git", args...)
+	cmd.Dir = g.repoPath
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		// Check if it's a conflict (exit code 1) vs other error
+		if exitError, ok := err.(*exec.ExitError); ok && exitError.ExitCode() == 1 {
+			return fmt.Errorf("merge conflict for %s: %w", strings.Join(revs, " "), err)
+		}
+		return fmt.Errorf("failed to merge %s: %w\nOutput: %s", strings.Join(revs, " "), err, string(output))
+	}
+	return nil
+}
+
+// ResetHard points the current branch, index and working tree at rev
+func (g *Git) ResetHard(rev string) error {
+	cmd := exec.Command("git", "reset", "--hard", "--quiet", rev)
+	cmd.Dir = g.repoPath
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to reset to %s: %w\nOutput: %s", rev, err, string(output))
+	}
+	return nil
+}
+
+func (g *Git) GetCommitMessage(rev string) (string, error) {
+	hash, err := g.repo.ResolveRevision(plumbing.Revision(rev))
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s: %w", rev, err)
+	}
+
+	commit, err := g.repo.CommitObject(*hash)
+	if err != nil {
+		return "", fmt.Errorf("failed to get commit %s: %w", rev, err)
+	}
+
+	return strings.TrimSpace(commit.Message), nil
+}
+
+// AmendCommit amends HEAD with the staged changes, replacing its message.
+// git strips comment lines and refuses a message that is empty after that.
+func (g *Git) AmendCommit(message string) error {
+	return g.amend(message, false)
+}
+
+// SquashHead folds HEAD into its parent with message
+func (g *Git) SquashHead(message string) error {
+	return g.foldHead(message, false)
+}
+
+// FixupHead folds HEAD into its parent, keeping the parent's message
+func (g *Git) FixupHead() error {
+	return g.foldHead("", true)
+}
+
+// foldHead folds HEAD into its parent by amending the parent. If the amend
+// fails, HEAD is put back so the fold can be retried.
+func (g *Git) foldHead(message string, keepMessage bool) error {
+	head, err := g.ResolveRevision("HEAD")
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command("git", "reset", "--soft", "HEAD~1")
+	cmd.Dir = g.repoPath
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to squash commit: %w\nOutput: %s", err, string(output))
+	}
+
+	if err := g.amend(message, keepMessage); err != nil {
+		restore := exec.Command("git", "reset", "--soft", head)
+		restore.Dir = g.repoPath
+		if output, restoreErr := restore.CombinedOutput(); restoreErr != nil {
+			return fmt.Errorf("%w\nand failed to restore HEAD to %s: %v\nOutput: %s", err, head, restoreErr, string(output))
+		}
+		return err
+	}
+	return nil
+}
+
+// amend amends HEAD with the staged changes, with message or, if
+// keepMessage is set, with its current message
+func (g *Git) amend(message string, keepMessage bool) error {
+	args := []string{"commit", "--amend", "--allow-empty"}
+	if keepMessage {
+		args = append(args, "--no-edit")
+	} else {
+		// Let git strip comment lines from the edited message
+		args = append(args, "--cleanup=strip", "-F", "-")
+	}
+
+	cmd := exec.Command("git", args...)
+	cmd.Dir = g.repoPath
+	cmd.Stdin = strings.NewReader(message)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to amend commit: %w\nOutput: %s", err, string(output))
+	}
+	return nil
+}
+
+// Exec runs a shell command in the working tree, streaming its output
+func (g *Git) Exec(command string) error {
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Dir = g.repoPath
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// UpdateRef points ref at newSHA, provided it currently points at oldSHA
+func (g *Git) UpdateRef(ref, newSHA, oldSHA string) error {
+	cmd := exec.Command("git", "update-ref", ref, newSHA, oldSHA)
+	cmd.Dir = g.repoPath
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to update %s: %w\nOutput: %s", ref, err, string(output))
+	}
+	return nil
+}
+
+// UpdateRefs applies all updates in a single transaction: either every ref
+// moves or, if any of them no longer has its expected old value, none does
+func (g *Git) UpdateRefs(message string, updates []RefUpdate) error {
+	var input strings.Builder
+	input.WriteString("start\n")
+	for _, update := range updates {
+		if update.OldSHA == "" {
+			fmt.Fprintf(&input, "create %s %s\n", update.Ref, update.NewSHA)
+		} else {
+			fmt.Fprintf(&input, "update %s %s %s\n", update.Ref, update.NewSHA, update.OldSHA)
+		}
+	}
+	input.WriteString("commit\n")
+
+	cmd := exec.Command("git", "update-ref", "-m", message, "--stdin")
+	cmd.Dir = g.repoPath
+	cmd.Stdin = strings.NewReader(input.String())
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to update refs: %w\nOutput: %s", err, string(output))
+	}
+	return nil
+}
+
+// SetHeadBranch points HEAD at branch without touching the index or working tree
+func (g *Git) SetHeadBranch(name string) error {
+	cmd := exec.Command("git", "symbolic-ref", "HEAD", "refs/heads/"+name)
+	cmd.Dir = g.repoPath
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to point HEAD at %s: %w\nOutput: %s", name, err, string(output))
+	}
+	return nil
+}
+
+// DeleteRef deletes ref, provided it currently points at oldSHA
+func (g *Git) DeleteRef(ref, oldSHA string) error {
+	cmd := exec.Command("git", "update-ref", "-d", ref, oldSHA)
+	cmd.Dir = g.repoPath
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to delete %s: %w\nOutput: %s", ref, err, string(output))
+	}
+	return nil
+}
+
+// GetRefs returns the commit SHA of every ref whose full name starts with
+// prefix, keyed by full name
+func (g *Git) GetRefs(prefix string) (map[string]string, error) {
+	refs, err := g.repo.References()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list refs: %w", err)
+	}
+	defer refs.Close()
+
+	result := make(map[string]string)
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() == plumbing.HashReference && strings.HasPrefix(ref.Name().String(), prefix) {
+			result[ref.Name().String()] = ref.Hash().String()
+		}
+		return nil
+	})
+
+	return result, err
+}
+
+// GetConfig returns the value of a git config key, or "" when it is not set
+func (g *Git) GetConfig(key string) (string, error) {
+	cmd := exec.Command("git", "config", "--get", key)
+	cmd.Dir = g.repoPath
+	output, err := cmd.Output()
+	if err != nil {
+		// Exit code 1 means the key is not set
+		if exitError, ok := err.(*exec.ExitError); ok && exitError.ExitCode() == 1 {
+			return "", nil
+		}
+		return "", fmt.Errorf("failed to read git config %s: %w", key, err)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
 func (g *Git) DeleteBranch(name string) error {
 	// Use git command to delete branch properly
 	cmd := exec.Command("git", "branch", "-D", name)
@@ -240,7 +1010,7 @@ func (g *Git) IsCleanWorkingDirectory() (bool, error) {
 }
 
 func (g *Git) HasOngoingOperation() (bool, string, error) {
-	gitDir := filepath.Join(g.repoPath, ".git")
+	gitDir := g.gitDir
 
 	// Check for various ongoing operations
 	operations := map[string]string{
@@ -260,41 +1030,91 @@ func (g *Git) HasOngoingOperation() (bool, string, error) {
 	return false, "", nil
 }
 
-func (g *Git) IsValidRepository() error {
-	// Check if .git directory exists
-	gitDir := filepath.Join(g.repoPath, ".git")
-	if _, err := os.Stat(gitDir); os.IsNotExist(err) {
-		return errors.New("not a git repository (no .git directory found)")
+// PendingCommit returns "cherry-pick" or "merge" when one stopped for
+// conflicts is waiting to be committed, or "" otherwise
+func (g *Git) PendingCommit() string {
+	gitDir := g.gitDir
+	if _, err := os.Stat(filepath.Join(gitDir, "CHERRY_PICK_HEAD")); err == nil {
+		return "cherry-pick"
+	}
+	if _, err := os.Stat(filepath.Join(gitDir, "MERGE_HEAD")); err == nil {
+		return "merge"
 	}
+	return ""
+}
 
-	// Try to get HEAD
-	_, err := g.repo.Head()
-	if err != nil {
-		return fmt.Errorf("invalid git repository: %w", err)
+// CommitPending commits the resolved cherry-pick or merge with its original
+// author and message
+func (g *Git) CommitPending() error {
+	args := []string{"-c", "core.editor=true", "commit"}
+	if g.PendingCommit() == "cherry-pick" {
+		args = []string{"-c", "core.editor=true", "cherry-pick", "--continue"}
 	}
 
+	cmd := exec.Command("git", args...)
+	cmd.Dir = g.repoPath
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to commit resolved conflicts: %w\nOutput: %s", err, string(output))
+	}
 	return nil
 }
 
-// isAncestor checks if ancestor is an ancestor of descendant
-func (g *Git) isAncestor(ancestor, descendant plumbing.Hash) (bool, error) {
-	if ancestor == descendant {
-		return true, nil
+// UnmergedPaths returns the paths that still have conflicts in the index
+func (g *Git) UnmergedPaths() ([]string, error) {
+	cmd := exec.Command("git", "diff", "--name-only", "--diff-filter=U")
+	cmd.Dir = g.repoPath
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list unmerged paths: %w", err)
 	}
+	return uniqueLines(strings.Split(strings.TrimSpace(string(output)), "\n")), nil
+}
 
-	descendantCommit, err := g.repo.CommitObject(descendant)
-	if err != nil {
-		return false, err
+// UnstagedPaths returns the paths whose changes are not staged, including
+// untracked files
+func (g *Git) UnstagedPaths() ([]string, error) {
+	var paths []string
+	for _, args := range [][]string{
+		{"diff", "--name-only"},
+		{"ls-files", "--others", "--exclude-standard"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = g.repoPath
+		output, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list unstaged paths: %w", err)
+		}
+		paths = append(paths, strings.Split(strings.TrimSpace(string(output)), "\n")...)
+	}
+	return uniqueLines(paths), nil
+}
+
+func (g *Git) IsValidRepository() error {
+	// Check if the git directory still exists
+	if _, err := os.Stat(g.gitDir); os.IsNotExist(err) {
+		return errors.New("not a git repository (no .git directory found)")
 	}
 
-	ancestorCommit, err := g.repo.CommitObject(ancestor)
+	// Try to get HEAD
+	_, err := g.repo.Head()
 	if err != nil {
-		return false, err
+		return fmt.Errorf("invalid git repository: %w", err)
 	}
 
-	return descendantCommit.IsAncestor(ancestorCommit)
+	return nil
 }
 
 func (g *Git) GetRepoPath() string {
 	return g.repoPath
+}
+
+// GetGitDir returns the git directory of the working tree
+func (g *Git) GetGitDir() string {
+	return g.gitDir
+}
+
+// GetCommonDir returns the git directory shared by all worktrees of the repository
+func (g *Git) GetCommonDir() string {
+	return g.commonDir
 }
\ No newline at end of file
@@ -1,9 +1,12 @@
 package rebranch_test
 
 import (
+	"bytes"
+	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"rebranch"
@@ -84,6 +87,15 @@ func createCommit(repoPath, filename, content, message string) error {
 	return cmd.Run()
 }
 
+// revParse resolves a revision to its full SHA
+func revParse(t *testing.T, repoPath, rev string) string {
+	cmd := exec.Command("git", "rev-parse", rev)
+	cmd.Dir = repoPath
+	output, err := cmd.Output()
+	require.NoError(t, err)
+	return strings.TrimSpace(string(output))
+}
+
 // createBranch creates a new branch and optionally switches to it
 func createBranch(repoPath, branchName string, checkout bool) error {
 	var cmd *exec.Cmd
@@ -171,6 +183,54 @@ func TestCheckoutBranch(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestFindBaseBranch(t *testing.T) {
+	repoPath, git, cleanup := setupTestRepo(t)
+	defer cleanup()
+
+	currentBranch, err := git.GetCurrentBranch()
+	require.NoError(t, err)
+	require.NoError(t, createBranch(repoPath, "feature", true))
+
+	runGit := func(args ...string) {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = repoPath
+		require.NoError(t, cmd.Run())
+	}
+
+	// Nothing to infer from
+	runGit("branch", "-m", currentBranch, "trunk")
+	_, err = git.FindBaseBranch("feature")
+	assert.Error(t, err)
+	runGit("branch", "-m", "trunk", currentBranch)
+
+	// Fall back to main/master
+	base, err := git.FindBaseBranch("feature")
+	require.NoError(t, err)
+	assert.Equal(t, currentBranch, base)
+
+	// The remote default branch wins over main/master
+	runGit("update-ref", "refs/remotes/origin/trunk", currentBranch)
+	runGit("symbolic-ref", "refs/remotes/origin/HEAD", "refs/remotes/origin/trunk")
+	base, err = git.FindBaseBranch("feature")
+	require.NoError(t, err)
+	assert.Equal(t, "origin/trunk", base)
+
+	// Tracking the pushed copy of the same branch is not a base
+	runGit("config", "branch.feature.remote", "origin")
+	runGit("config", "branch.feature.merge", "refs/heads/feature")
+	base, err = git.FindBaseBranch("feature")
+	require.NoError(t, err)
+	assert.Equal(t, "origin/trunk", base)
+
+	// A configured upstream wins over everything
+	require.NoError(t, createBranch(repoPath, "develop", false))
+	runGit("config", "branch.feature.remote", ".")
+	runGit("config", "branch.feature.merge", "refs/heads/develop")
+	base, err = git.FindBaseBranch("feature")
+	require.NoError(t, err)
+	assert.Equal(t, "develop", base)
+}
+
 func TestGetCommitsBetween(t *testing.T) {
 	repoPath, git, cleanup := setupTestRepo(t)
 	defer cleanup()
@@ -215,6 +275,227 @@ func TestGetCommitsBetween(t *testing.T) {
 	assert.Len(t, commitInfos, 0)
 }
 
+func TestGetCommitsBetweenNonLinear(t *testing.T) {
+	repoPath, git, cleanup := setupTestRepo(t)
+	defer cleanup()
+
+	currentBranch, _ := git.GetCurrentBranch()
+
+	runGit := func(env []string, args ...string) {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = repoPath
+		cmd.Env = append(os.Environ(), env...)
+		require.NoError(t, cmd.Run())
+	}
+
+	// feature merges main in the middle, then gets a commit whose committer
+	// date is older than everything on main
+	require.NoError(t, createBranch(repoPath, "feature", true))
+	require.NoError(t, createCommit(repoPath, "feature1.txt", "Feature 1", "Feature 1"))
+	runGit(nil, "checkout", currentBranch)
+	require.NoError(t, createCommit(repoPath, "main1.txt", "Main 1", "Main 1"))
+	runGit(nil, "checkout", "feature")
+	runGit(nil, "merge", "--no-edit", currentBranch)
+	require.NoError(t, os.WriteFile(filepath.Join(repoPath, "feature2.txt"), []byte("Feature 2"), 0644))
+	runGit(nil, "add", "feature2.txt")
+	runGit([]string{"GIT_COMMITTER_DATE=2001-01-01T00:00:00Z"}, "commit", "-m", "Feature 2")
+	runGit(nil, "checkout", currentBranch)
+	require.NoError(t, createCommit(repoPath, "main2.txt", "Main 2", "Main 2"))
+
+	commits, err := git.GetCommitsBetween(currentBranch, "feature")
+	require.NoError(t, err)
+
+	// Same commits as git rev-list
+	cmd := exec.Command("git", "rev-list", "--parents", currentBranch+"..feature")
+	cmd.Dir = repoPath
+	output, err := cmd.Output()
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	require.Len(t, commits, len(lines))
+
+	position := make(map[string]int, len(commits))
+	for i, commit := range commits {
+		position[commit.SHA] = i
+	}
+
+	// Every commit comes after its parents in the range
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		require.Contains(t, position, fields[0])
+		for _, parent := range fields[1:] {
+			if parentPos, ok := position[parent]; ok {
+				assert.Less(t, parentPos, position[fields[0]])
+			}
+		}
+	}
+}
+
+// generateLargeRepo uses git fast-import to build a repository with
+// mainCommits commits on main and a feature branch of featureCommits commits
+// that forked behindCommits commits before main's tip
+func generateLargeRepo(b *testing.B, mainCommits, featureCommits, behindCommits int) string {
+	repoPath := b.TempDir()
+
+	cmd := exec.Command("git", "init", "--quiet", "--initial-branch=main")
+	cmd.Dir = repoPath
+	require.NoError(b, cmd.Run())
+
+	var stream bytes.Buffer
+	writeCommit := func(ref string, mark, from, date int, file string) {
+		message := fmt.Sprintf("Commit %d", mark)
+		content := fmt.Sprintf("%d\n", mark)
+		fmt.Fprintf(&stream, "commit %s\nmark :%d\ncommitter Test <test@example.com> %d +0000\n", ref, mark, date)
+		fmt.Fprintf(&stream, "data %d\n%s\n", len(message), message)
+		if from > 0 {
+			fmt.Fprintf(&stream, "from :%d\n", from)
+		}
+		fmt.Fprintf(&stream, "M 644 inline %s\ndata %d\n%s\n", file, len(content), content)
+	}
+
+	const start = 1000000000
+	for i := 1; i <= mainCommits; i++ {
+		writeCommit("refs/heads/main", i, i-1, start+i*60, fmt.Sprintf("dir%d/file.txt", i%100))
+	}
+	forkPoint := mainCommits - behindCommits
+	for i := 1; i <= featureCommits; i++ {
+		mark, from := mainCommits+i, mainCommits+i-1
+		if i == 1 {
+			from = forkPoint
+		}
+		writeCommit("refs/heads/feature", mark, from, start+forkPoint*60+i*60, fmt.Sprintf("feature/file%d.txt", i))
+	}
+
+	cmd = exec.Command("git", "fast-import", "--quiet")
+	cmd.Dir = repoPath
+	cmd.Stdin = &stream
+	output, err := cmd.CombinedOutput()
+	require.NoError(b, err, string(output))
+
+	return repoPath
+}
+
+func BenchmarkGetCommitsBetween(b *testing.B) {
+	repoPath := generateLargeRepo(b, 100000, 150, 100)
+
+	run := func(b *testing.B) {
+		git, err := rebranch.NewGitInPath(repoPath)
+		require.NoError(b, err)
+
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			commits, err := git.GetCommitsBetween("main", "feature")
+			require.NoError(b, err)
+			require.Len(b, commits, 150)
+		}
+	}
+
+	b.Run("objects", run)
+
+	cmd := exec.Command("git", "commit-graph", "write", "--reachable")
+	cmd.Dir = repoPath
+	require.NoError(b, cmd.Run())
+
+	b.Run("commit-graph", run)
+}
+
+func TestMarkMergedCommits(t *testing.T) {
+	repoPath, git, cleanup := setupTestRepo(t)
+	defer cleanup()
+
+	currentBranch, _ := git.GetCurrentBranch()
+
+	// Create feature branch with two commits
+	err := createBranch(repoPath, "feature", true)
+	require.NoError(t, err)
+	require.NoError(t, createCommit(repoPath, "merged.txt", "Merged content", "Merged upstream"))
+	require.NoError(t, createCommit(repoPath, "pending.txt", "Pending content", "Not merged yet"))
+
+	commits, err := git.GetCommitsBetween(currentBranch, "feature")
+	require.NoError(t, err)
+	require.Len(t, commits, 2)
+
+	// Rewrite the first commit onto the base branch, giving it a new SHA
+	require.NoError(t, git.CheckoutBranch(currentBranch))
+	require.NoError(t, createCommit(repoPath, "unrelated.txt", "Unrelated content", "Unrelated upstream work"))
+	require.NoError(t, git.CherryPick(commits[0].SHA))
+	upstreamSHA := revParse(t, repoPath, "HEAD")
+	require.NotEqual(t, commits[0].SHA, upstreamSHA)
+
+	err = git.MarkMergedCommits(currentBranch, "feature", commits)
+	require.NoError(t, err)
+
+	assert.Equal(t, "drop", commits[0].Action)
+	assert.Equal(t, upstreamSHA, commits[0].UpstreamSHA)
+	assert.Equal(t, "pick", commits[1].Action)
+	assert.Empty(t, commits[1].UpstreamSHA)
+}
+
+func TestHasChangesApplied(t *testing.T) {
+	repoPath, git, cleanup := setupTestRepo(t)
+	defer cleanup()
+
+	currentBranch, _ := git.GetCurrentBranch()
+
+	// Create parent branch with two commits touching the same file
+	err := createBranch(repoPath, "parent", true)
+	require.NoError(t, err)
+	require.NoError(t, createCommit(repoPath, "parent.txt", "draft\n", "Add parent"))
+	require.NoError(t, createCommit(repoPath, "parent.txt", "final\n", "Polish parent"))
+
+	// Squash-merge the parent branch into the base branch
+	require.NoError(t, git.CheckoutBranch(currentBranch))
+	require.NoError(t, createCommit(repoPath, "parent.txt", "final\n", "Parent (squashed)"))
+
+	// The combined changes are present, the first commit alone is not
+	applied, err := git.HasChangesApplied(currentBranch, "parent~2", "parent")
+	require.NoError(t, err)
+	assert.True(t, applied)
+
+	applied, err = git.HasChangesApplied(currentBranch, "parent~2", "parent~1")
+	require.NoError(t, err)
+	assert.False(t, applied)
+}
+
+func TestSimulateCherryPick(t *testing.T) {
+	repoPath, git, cleanup := setupTestRepo(t)
+	defer cleanup()
+
+	currentBranch, _ := git.GetCurrentBranch()
+
+	err := createBranch(repoPath, "feature", true)
+	require.NoError(t, err)
+	require.NoError(t, createCommit(repoPath, "clean.txt", "feature\n", "Clean change"))
+	require.NoError(t, createCommit(repoPath, "shared.txt", "feature\n", "Conflicting change"))
+	require.NoError(t, createCommit(repoPath, "same.txt", "same\n", "Already upstream"))
+
+	require.NoError(t, git.CheckoutBranch(currentBranch))
+	require.NoError(t, createCommit(repoPath, "shared.txt", "main\n", "Main change"))
+	require.NoError(t, createCommit(repoPath, "same.txt", "same\n", "Same change"))
+	mainSHA := revParse(t, repoPath, currentBranch)
+
+	result, conflicts, err := git.SimulateCherryPick(currentBranch, "feature~2")
+	require.NoError(t, err)
+	assert.Empty(t, conflicts)
+	assert.NotEqual(t, mainSHA, result)
+	assert.Equal(t, mainSHA, revParse(t, repoPath, result+"^"))
+	assert.Equal(t, revParse(t, repoPath, "feature~2:clean.txt"), revParse(t, repoPath, result+":clean.txt"))
+
+	_, conflicts, err = git.SimulateCherryPick(currentBranch, "feature~1")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"shared.txt"}, conflicts)
+
+	result, conflicts, err = git.SimulateCherryPick(mainSHA, "feature")
+	require.NoError(t, err)
+	assert.Empty(t, conflicts)
+	assert.Equal(t, mainSHA, result)
+
+	// Nothing was changed
+	assert.Equal(t, mainSHA, revParse(t, repoPath, "HEAD"))
+	clean, err := git.IsCleanWorkingDirectory()
+	require.NoError(t, err)
+	assert.True(t, clean)
+}
+
 func TestCherryPick(t *testing.T) {
 	repoPath, git, cleanup := setupTestRepo(t)
 	defer cleanup()
@@ -249,6 +530,75 @@ func TestCherryPick(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestGetRefsAndDeleteRef(t *testing.T) {
+	repoPath, git, cleanup := setupTestRepo(t)
+	defer cleanup()
+
+	head := revParse(t, repoPath, "HEAD")
+
+	// UpdateRef with an empty old value only creates
+	require.NoError(t, git.UpdateRef("refs/rebranch/backup/feature/1", head, ""))
+	require.NoError(t, git.UpdateRef("refs/rebranch/backup/topic/x/2", head, ""))
+	assert.Error(t, git.UpdateRef("refs/rebranch/backup/feature/1", head, ""))
+
+	refs, err := git.GetRefs("refs/rebranch/backup/")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"refs/rebranch/backup/feature/1": head,
+		"refs/rebranch/backup/topic/x/2": head,
+	}, refs)
+
+	// DeleteRef checks the old value
+	assert.Error(t, git.DeleteRef("refs/rebranch/backup/feature/1", strings.Repeat("1", 40)))
+	require.NoError(t, git.DeleteRef("refs/rebranch/backup/feature/1", head))
+
+	refs, err = git.GetRefs("refs/rebranch/backup/feature/")
+	require.NoError(t, err)
+	assert.Empty(t, refs)
+
+	// Unset config keys are empty, not an error
+	value, err := git.GetConfig("rebranch.keepBackups")
+	require.NoError(t, err)
+	assert.Empty(t, value)
+
+	cmd := exec.Command("git", "config", "rebranch.keepBackups", "3")
+	cmd.Dir = repoPath
+	require.NoError(t, cmd.Run())
+	value, err = git.GetConfig("rebranch.keepBackups")
+	require.NoError(t, err)
+	assert.Equal(t, "3", value)
+}
+
+func TestUpdateRefs(t *testing.T) {
+	repoPath, git, cleanup := setupTestRepo(t)
+	defer cleanup()
+
+	first := revParse(t, repoPath, "HEAD")
+	require.NoError(t, createCommit(repoPath, "second.txt", "Second", "Second commit"))
+	second := revParse(t, repoPath, "HEAD")
+	require.NoError(t, createBranch(repoPath, "topic", false))
+
+	// One stale old value and nothing moves
+	err := git.UpdateRefs("test", []rebranch.RefUpdate{
+		{Ref: "refs/heads/topic", NewSHA: first, OldSHA: second},
+		{Ref: "refs/rebranch/backup/topic/1", NewSHA: second},
+		{Ref: "refs/heads/other", NewSHA: first, OldSHA: second},
+	})
+	assert.Error(t, err)
+	assert.Equal(t, second, revParse(t, repoPath, "topic"))
+	refs, err := git.GetRefs("refs/rebranch/")
+	require.NoError(t, err)
+	assert.Empty(t, refs)
+
+	err = git.UpdateRefs("test", []rebranch.RefUpdate{
+		{Ref: "refs/heads/topic", NewSHA: first, OldSHA: second},
+		{Ref: "refs/rebranch/backup/topic/1", NewSHA: second},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, first, revParse(t, repoPath, "topic"))
+	assert.Equal(t, second, revParse(t, repoPath, "refs/rebranch/backup/topic/1"))
+}
+
 func TestDeleteBranch(t *testing.T) {
 	repoPath, git, cleanup := setupTestRepo(t)
 	defer cleanup()
@@ -368,6 +718,30 @@ func TestIsValidRepository(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestNewGitInSubdirectory(t *testing.T) {
+	repoPath, _, cleanup := setupTestRepo(t)
+	defer cleanup()
+
+	subDir := filepath.Join(repoPath, "src", "pkg")
+	require.NoError(t, os.MkdirAll(subDir, 0755))
+
+	git, err := rebranch.NewGitInPath(subDir)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(repoPath, ".git"), git.GetGitDir())
+
+	// Status covers the whole working tree, not just the subdirectory
+	isClean, err := git.IsCleanWorkingDirectory()
+	require.NoError(t, err)
+	assert.True(t, isClean)
+	require.NoError(t, os.WriteFile(filepath.Join(repoPath, "dirty.txt"), []byte("dirty content"), 0644))
+	isClean, err = git.IsCleanWorkingDirectory()
+	require.NoError(t, err)
+	assert.False(t, isClean)
+
+	// Commands run from the top level
+	assert.NoError(t, git.Exec("test -f initial.txt"))
+}
+
 func TestNewGitErrors(t *testing.T) {
 	// Test NewGit with invalid directory
 	originalDir, _ := os.Getwd()
@@ -1,8 +1,15 @@
 package rebranch
 
 import (
+	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"time"
 )
 
@@ -10,23 +17,62 @@ const (
 	TempBranchPrefix = "rebranch-temp-"
 	StateFileName    = "REBRANCH_STATE"
 	PickFileName     = "REBRANCH_PICK"
+	MessageFileName  = "REBRANCH_MSG"
+	LockFileName     = "REBRANCH_LOCK"
+	BackupRefPrefix  = "refs/rebranch/backup/"
+
+	// StateVersion is the version of the state file format written by SaveState
+	StateVersion = 1
+
+	// DefaultKeepBackups is how many backups per branch --done keeps unless
+	// rebranch.keepBackups is set
+	DefaultKeepBackups = 10
+
+	// MaxSquashMergedPrefix is the longest prefix of the range checked for a
+	// squash-merged parent branch. Every length checked costs an in-memory merge.
+	MaxSquashMergedPrefix = 20
 )
 
 // RebranchState represents the current operation state
 type RebranchState struct {
-	SourceBranch     string       `json:"source_branch"`
-	BaseBranch       string       `json:"base_branch"`
-	TempBranch       string       `json:"temp_branch"`
-	CommitsToApply   []CommitInfo `json:"commits_to_apply"`
-	CurrentCommitIdx int          `json:"current_commit_idx"`
-	Stage            string       `json:"stage"` // "picking", "conflicts", "done"
+	Version          int               `json:"version"` // StateVersion the file was written with
+	SourceBranch     string            `json:"source_branch"`
+	BaseBranch       string            `json:"base_branch"`
+	BaseSHA          string            `json:"base_sha,omitempty"`     // Commit BaseBranch resolved to at start
+	Upstream         string            `json:"upstream,omitempty"`     // With --onto, commits after this revision are rebranched
+	UpstreamSHA      string            `json:"upstream_sha,omitempty"` // Commit Upstream resolved to at start
+	TempBranch       string            `json:"temp_branch"`
+	Worktree         string            `json:"worktree,omitempty"` // Linked worktree the commits are applied in (--worktree)
+	CommitsToApply   []CommitInfo      `json:"commits_to_apply"`
+	CurrentCommitIdx int               `json:"current_commit_idx"`
+	Stage            string            `json:"stage"` // "picking", "conflicts", "editing", "exec-failed", "message-failed", "done", "finishing"
+	StackBranches    []StackBranch     `json:"stack_branches,omitempty"`
+	Labels           map[string]string `json:"labels,omitempty"`       // Commits recorded by label entries
+	SourceSHA        string            `json:"source_sha,omitempty"`   // Tip of SourceBranch the commits were taken from; --done replaces it
+	NewSHA           string            `json:"new_sha,omitempty"`      // Tip of TempBranch that --done moves SourceBranch to
+	BackupRef        string            `json:"backup_ref,omitempty"`   // Ref --done saves SourceSHA under
+	StoppedHEAD      string            `json:"stopped_head,omitempty"` // HEAD before the commit the rebranch stopped at; a resolution goes on top, --skip resets to it
+}
+
+// StackBranch is a dependent branch whose tip lies inside the rebranched range
+type StackBranch struct {
+	Name   string `json:"name"`
+	OldSHA string `json:"old_sha"`
+	NewSHA string `json:"new_sha,omitempty"` // Set when its update-ref line is reached
 }
 
 // CommitInfo represents a commit in the interactive list
 type CommitInfo struct {
-	SHA     string `json:"sha"`
-	Message string `json:"message"`
-	Action  string `json:"action"` // "pick" or "drop"
+	SHA          string   `json:"sha"`
+	Message      string   `json:"message"`
+	Action       string   `json:"action"`                  // "pick", "reword", "edit", "squash", "fixup", "exec", "update-ref", "label", "reset", "merge" or "drop"
+	UpstreamSHA  string   `json:"upstream_sha,omitempty"`  // Upstream commit with the same patch-id
+	SquashMerged bool     `json:"squash_merged,omitempty"` // Part of a prefix already squash-merged upstream
+	MergedIn     bool     `json:"merged_in,omitempty"`     // Brought in by a merge; dropped by --merges=skip
+	Command      string   `json:"command,omitempty"`       // Shell command of an exec entry
+	Ref          string   `json:"ref,omitempty"`           // Branch ref of an update-ref entry
+	Parents      []string `json:"parents,omitempty"`       // Parent SHAs; more than one for a merge commit
+	Label        string   `json:"label,omitempty"`         // Name of a label or reset entry, or the parents of a merge entry
 }
 
 // Options provides configuration for RunCmd
@@ -36,13 +82,6 @@ type Options struct {
 
 // RunCmd is the main entry point called from cmd/main.go
 func RunCmd(args []string, opts Options) error {
-	if len(args) == 0 {
-		return errors.New("no command provided\n" +
-			"\n" +
-			"Usage: rebranch <base-branch> | --continue | --done | --abort\n" +
-			"Run 'rebranch --help' for more information")
-	}
-
 	git, err := NewGit()
 	if err != nil {
 		return fmt.Errorf("failed to initialize git: %w", err)
@@ -58,34 +97,242 @@ func RunCmd(args []string, opts Options) error {
 		return fmt.Errorf("failed to initialize state manager: %w", err)
 	}
 
-	switch args[0] {
+	command := ""
+	if len(args) > 0 {
+		command = args[0]
+	}
+
+	// Commands that change the state or refs hold the lock while they run;
+	// --status, --list-backups and --dry-run only read
+	switch command {
 	case "--continue":
-		return continueRebranch(git, state)
+		return withLock(state, func() error { return continueRebranch(git, editor, state) })
+	case "--status":
+		return statusRebranch(git, state)
+	case "--skip":
+		return withLock(state, func() error { return skipRebranch(git, editor, state) })
+	case "--fold-new":
+		return withLock(state, func() error { return foldNewCommits(git, editor, state) })
 	case "--done":
-		return finishRebranch(git, state)
+		return withLock(state, func() error { return finishRebranch(git, state) })
 	case "--abort":
-		return abortRebranch(git, state)
+		return withLock(state, func() error { return abortRebranch(git, state) })
+	case "--repair":
+		return withLock(state, func() error { return repairRebranch(git, state) })
+	case "--undo", "--list-backups":
+		// Both take an optional branch name
+		if len(args) > 2 {
+			return fmt.Errorf("expected at most one branch\n"+
+				"\n"+
+				"Usage: rebranch %s [<branch>]", command)
+		}
+		branch := ""
+		if len(args) == 2 {
+			branch = args[1]
+		}
+		if command == "--undo" {
+			return withLock(state, func() error { return undoRebranch(git, state, branch) })
+		}
+		return listBackupsRebranch(git, branch)
+	default:
+		startOpts, err := parseStartArgs(args)
+		if err != nil {
+			return err
+		}
+		if startOpts.baseBranch == "" {
+			if startOpts.baseBranch, err = inferBaseBranch(git); err != nil {
+				return err
+			}
+		}
+		if startOpts.dryRun {
+			return startRebranch(startOpts, git, editor, state)
+		}
+		return withLock(state, func() error { return startRebranch(startOpts, git, editor, state) })
+	}
+}
+
+// withLock runs fn while holding the store's lock, so two rebranch processes
+// never apply commits or move refs at the same time
+func withLock(store Store, fn func() error) error {
+	if err := store.Lock(); err != nil {
+		return err
+	}
+
+	err := fn()
+	if unlockErr := store.Unlock(); unlockErr != nil && err == nil {
+		err = unlockErr
+	}
+	return err
+}
+
+// startOptions holds the arguments and flags accepted when starting a rebranch
+type startOptions struct {
+	baseBranch   string
+	upstream     string // Set with --onto; the range starts here instead of at baseBranch
+	merges       string // "skip", "linearize" or "rebase-merges"
+	dryRun       bool
+	worktree     bool // Apply the commits in a linked worktree, leaving the checkout alone
+	dropMissing  bool
+	execCommands []string
+	stack        bool
+}
+
+// stringList collects the values of a repeatable flag
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// parseStartArgs parses "rebranch [flags] [<base-branch>]" and
+// "rebranch [flags] --onto <newbase> <upstream>", allowing flags on either
+// side of the positional argument
+func parseStartArgs(args []string) (startOptions, error) {
+	var opts startOptions
+
+	flags := flag.NewFlagSet("rebranch", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	flags.BoolVar(&opts.dropMissing, "drop-missing", false, "Treat commits removed from the pick file as dropped")
+	flags.Var((*stringList)(&opts.execCommands), "exec", "Run a command after each applied commit")
+	flags.BoolVar(&opts.stack, "stack", false, "Also move dependent branches inside the range")
+	flags.BoolVar(&opts.stack, "update-refs", false, "Alias for --stack")
+	flags.StringVar(&opts.baseBranch, "onto", "", "Create the new branch from this revision instead of the base")
+	flags.StringVar(&opts.merges, "merges", "linearize", "How to handle merge commits: skip, linearize or rebase-merges")
+	flags.BoolVar(&opts.dryRun, "dry-run", false, "Predict conflicts without changing anything")
+	flags.BoolVar(&opts.worktree, "worktree", false, "Apply the commits in a separate worktree")
+
+	var positional []string
+	for {
+		if err := flags.Parse(args); err != nil {
+			return opts, fmt.Errorf("%v\n"+
+				"\n"+
+				"Run 'rebranch --help' for more information", err)
+		}
+		if flags.NArg() == 0 {
+			break
+		}
+		positional = append(positional, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+
+	switch opts.merges {
+	case "skip", "linearize", "rebase-merges":
 	default:
-		return startRebranch(args[0], git, editor, state)
+		return opts, fmt.Errorf("invalid --merges mode '%s' (must be skip, linearize or rebase-merges)", opts.merges)
+	}
+
+	usage := "Usage: rebranch [--drop-missing] [--exec <cmd>] [--stack] [--merges <mode>] [--worktree] [<base-branch>]\n" +
+		"       rebranch [options] --onto <newbase> <upstream>\n" +
+		"Run 'rebranch --help' for more information"
+
+	switch {
+	case len(positional) > 1:
+		return opts, errors.New("expected at most one base branch\n" +
+			"\n" + usage)
+	case opts.baseBranch != "":
+		// With --onto the positional argument only limits the commit range
+		if len(positional) == 0 {
+			return opts, errors.New("--onto requires an upstream\n" +
+				"\n" + usage)
+		}
+		opts.upstream = positional[0]
+	case len(positional) == 1:
+		opts.baseBranch = positional[0]
 	}
+
+	return opts, nil
+}
+
+// inferBaseBranch picks the base when none is given on the command line
+func inferBaseBranch(git GitInterface) (string, error) {
+	currentBranch, err := git.GetCurrentBranch()
+	if err != nil {
+		return "", fmt.Errorf("failed to get current branch: %w", err)
+	}
+
+	base, err := git.FindBaseBranch(currentBranch)
+	if err != nil {
+		return "", fmt.Errorf("no base branch given and none could be inferred: %v\n"+
+			"\n"+
+			"Suggestions:\n"+
+			"  • Pass the base explicitly: rebranch <base-branch>\n"+
+			"  • Set an upstream: git branch --set-upstream-to=<base-branch>\n"+
+			"  • Record the remote default branch: git remote set-head origin --auto", err)
+	}
+
+	fmt.Printf("No base branch given, using %s\n", base)
+	return base, nil
 }
 
 // startRebranch begins interactive rebranching process
-func startRebranch(baseBranch string, git GitInterface, editor EditorInterface, store Store) error {
-	if err := validateStart(baseBranch, git, store); err != nil {
+func startRebranch(opts startOptions, git GitInterface, editor EditorInterface, store Store) error {
+	baseBranch := opts.baseBranch
+	var err error
+	if opts.dryRun {
+		err = validateDryRun(baseBranch, opts.upstream, git)
+	} else {
+		err = validateStart(baseBranch, opts.upstream, git, store)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Pin the base to a commit so a later fetch cannot move it under us
+	baseSHA, err := git.ResolveRevision(baseBranch)
+	if err != nil {
 		return err
 	}
 
+	// Without --onto the commit range starts at the base itself
+	rangeStart, rangeStartSHA := baseBranch, baseSHA
+	var upstreamSHA string
+	if opts.upstream != "" {
+		upstreamSHA, err = git.ResolveRevision(opts.upstream)
+		if err != nil {
+			return err
+		}
+		rangeStart, rangeStartSHA = opts.upstream, upstreamSHA
+	}
+
 	// Get current branch and commits
 	sourceBranch, err := git.GetCurrentBranch()
 	if err != nil {
 		return err
 	}
 
-	commits, err := git.GetCommitsBetween(baseBranch, sourceBranch)
+	// Pin the source too, so commits added to it later are noticed
+	sourceSHA, err := git.ResolveRevision("refs/heads/" + sourceBranch)
+	if err != nil {
+		return err
+	}
+
+	commits, err := git.GetCommitsBetween(rangeStartSHA, sourceSHA)
 	if err != nil {
 		return err
 	}
+	commits = selectMergeCommits(commits, opts.merges)
+
+	// Pre-drop commits that were already merged upstream under a different SHA
+	if err := git.MarkMergedCommits(baseSHA, sourceSHA, commits); err != nil {
+		return err
+	}
+
+	// Pre-drop the commits of a parent branch that was squash-merged into
+	// base. This is only a convenience, so a failed check does not stop the rebranch.
+	merged, err := findSquashMergedPrefix(git, baseSHA, commits)
+	if err != nil {
+		fmt.Printf("Warning: could not check for squash-merged commits: %v\n", err)
+		merged = 0
+	}
+	for i := 0; i < merged; i++ {
+		commits[i].Action = "drop"
+		commits[i].SquashMerged = true
+	}
 
 	if len(commits) == 0 {
 		return fmt.Errorf("no commits to rebranch from '%s' onto '%s'\n"+
@@ -94,17 +341,56 @@ func startRebranch(baseBranch string, git GitInterface, editor EditorInterface,
 			"  • Current branch is up-to-date with base branch\n"+
 			"  • Current branch has no unique commits\n"+
 			"  • Check commit history: git log --oneline %s..%s", 
-			sourceBranch, baseBranch, baseBranch, sourceBranch)
+			sourceBranch, baseBranch, rangeStart, sourceBranch)
 	}
 
 	fmt.Printf("Found %d commits to rebranch from %s onto %s\n", len(commits), sourceBranch, baseBranch)
+	if opts.upstream != "" {
+		fmt.Printf("Only commits after %s are included\n", opts.upstream)
+	}
+	if merged > 0 {
+		fmt.Printf("The combined changes of the first %d commits are already in %s (squash-merged)\n", merged, baseBranch)
+	}
 	for i, commit := range commits {
-		fmt.Printf("  %d. %s %s\n", i+1, commit.SHA[:7], commit.Message)
+		if len(commit.Parents) > 1 {
+			fmt.Printf("  %d. %s %s (merge)\n", i+1, shortSHA(commit.SHA), commitSubject(commit.Message))
+			continue
+		}
+		if commit.UpstreamSHA != "" {
+			fmt.Printf("  %d. %s %s (already in %s as %s)\n", i+1, shortSHA(commit.SHA),
+				commitSubject(commit.Message), baseBranch, shortSHA(commit.UpstreamSHA))
+			continue
+		}
+		fmt.Printf("  %d. %s %s\n", i+1, shortSHA(commit.SHA), commitSubject(commit.Message))
+	}
+
+	if opts.dryRun {
+		return dryRunPicks(git, baseSHA, commits)
+	}
+
+	// Find the dependent branches to move along with the source branch
+	var stackBranches []StackBranch
+	if opts.stack {
+		stackBranches, err = findStackBranches(git, sourceBranch, baseBranch, commits)
+		if err != nil {
+			return err
+		}
+		if len(stackBranches) == 0 {
+			fmt.Printf("No dependent branches found inside %s..%s\n", rangeStart, sourceBranch)
+		}
+		for _, branch := range stackBranches {
+			fmt.Printf("Stacked branch %s at %s will be moved too\n", branch.Name, shortSHA(branch.OldSHA))
+		}
 	}
 
 	// Create and edit interactive file
-	pickFilePath := GetPickFilePath(git.GetRepoPath())
-	if err := CreateInteractiveFile(commits, pickFilePath); err != nil {
+	pickFilePath := GetPickFilePath(git.GetGitDir())
+	entries := commits
+	if opts.merges == "rebase-merges" {
+		entries = rebaseMergesScript(commits)
+	}
+	entries = insertExecCommands(insertUpdateRefs(entries, stackBranches), opts.execCommands)
+	if err := CreateInteractiveFile(entries, pickFilePath); err != nil {
 		return fmt.Errorf("failed to create pick file: %w", err)
 	}
 
@@ -114,31 +400,48 @@ func startRebranch(baseBranch string, git GitInterface, editor EditorInterface,
 	}
 
 	// Parse edited file
-	selectedCommits, err := ParseInteractiveFile(pickFilePath, commits)
+	selectedCommits, err := ParseInteractiveFile(pickFilePath, entries, opts.dropMissing)
 	if err != nil {
 		return fmt.Errorf("failed to parse pick file: %w", err)
 	}
 
-	fmt.Printf("\nSelected %d commits to apply\n", countPickedCommits(selectedCommits))
+	// Only branches whose update-ref line was kept are moved
+	stackBranches = selectedStackBranches(selectedCommits)
+
+	fmt.Printf("\nSelected %d commits to apply\n", countAppliedCommits(selectedCommits))
 
 	// Create temporary branch
-	tempBranch := fmt.Sprintf("%s%d", TempBranchPrefix, time.Now().Unix())
-	if err := git.CreateBranch(tempBranch, baseBranch); err != nil {
+	tempBranch, err := createTempBranch(git, baseSHA)
+	if err != nil {
 		return err
 	}
 
-	if err := git.CheckoutBranch(tempBranch); err != nil {
+	// With --worktree the checkout stays on the source branch until --done
+	var worktree string
+	if opts.worktree {
+		worktree = filepath.Join(git.GetCommonDir(), "rebranch", tempBranch)
+		if err := git.AddWorktree(worktree, tempBranch); err != nil {
+			return err
+		}
+		fmt.Printf("Applying commits in worktree %s\n", worktree)
+	} else if err := git.CheckoutBranch(tempBranch); err != nil {
 		return err
 	}
 
 	// Save initial state with selected commits
 	state := &RebranchState{
 		SourceBranch:     sourceBranch,
+		SourceSHA:        sourceSHA,
 		BaseBranch:       baseBranch,
+		BaseSHA:          baseSHA,
+		Upstream:         opts.upstream,
+		UpstreamSHA:      upstreamSHA,
 		TempBranch:       tempBranch,
+		Worktree:         worktree,
 		Stage:            "picking",
 		CommitsToApply:   selectedCommits,
 		CurrentCommitIdx: 0,
+		StackBranches:    stackBranches,
 	}
 
 	if err := store.SaveState(state); err != nil {
@@ -146,11 +449,15 @@ func startRebranch(baseBranch string, git GitInterface, editor EditorInterface,
 	}
 
 	// Start cherry-picking
-	return ApplyCherryPicks(git, store, state)
+	picker, err := worktreeGit(git, state)
+	if err != nil {
+		return err
+	}
+	return ApplyCherryPicks(picker, editor, store, state)
 }
 
-// continueRebranch resumes after conflict resolution
-func continueRebranch(git GitInterface, state Store) error {
+// continueRebranch resumes after conflict resolution or an edit stop
+func continueRebranch(git GitInterface, editor EditorInterface, state Store) error {
 	if err := validateContinue(git, state); err != nil {
 		return err
 	}
@@ -160,58 +467,115 @@ func continueRebranch(git GitInterface, state Store) error {
 		return err
 	}
 
+	git, err = worktreeGit(git, rebranchState)
+	if err != nil {
+		return err
+	}
+
+	// The resolved commit still needs its reword/squash/fixup applied, and a
+	// failed one is retried
+	switch rebranchState.Stage {
+	case "conflicts", "message-failed":
+		commit := rebranchState.CommitsToApply[rebranchState.CurrentCommitIdx]
+		if rebranchState.Stage == "conflicts" {
+			if err := commitResolution(git, commit, rebranchState.StoppedHEAD); err != nil {
+				return err
+			}
+		}
+		if err := finishCommit(git, editor, commit); err != nil {
+			return stopForMessage(state, rebranchState, commit, err)
+		}
+	}
+
 	rebranchState.CurrentCommitIdx++ // Move to next commit
 	rebranchState.Stage = "picking"
 
-	return ApplyCherryPicks(git, state, rebranchState)
+	return ApplyCherryPicks(git, editor, state, rebranchState)
 }
 
-// ApplyCherryPicks applies remaining commits from current index
-func ApplyCherryPicks(git GitInterface, store Store, state *RebranchState) error {
-	for i := state.CurrentCommitIdx; i < len(state.CommitsToApply); i++ {
-		commit := state.CommitsToApply[i]
-		if commit.Action == "drop" {
-			continue
-		}
-
-		err := git.CherryPick(commit.SHA)
+// commitResolution commits the resolved cherry-pick or merge of commit, or
+// checks the commit the user made themselves on top of stoppedHEAD
+func commitResolution(git GitInterface, commit CommitInfo, stoppedHEAD string) error {
+	pending := git.PendingCommit()
+	if pending == "" {
+		// The user committed the resolution themselves, or abandoned it
+		head, err := git.ResolveRevision("HEAD")
 		if err != nil {
-			state.CurrentCommitIdx = i
-			state.Stage = "conflicts"
-			if saveErr := store.SaveState(state); saveErr != nil {
-				return fmt.Errorf("cherry-pick failed and could not save state: %v", saveErr)
+			return err
+		}
+		if stoppedHEAD != "" {
+			onTop, err := git.IsAncestor(stoppedHEAD, head)
+			if err != nil {
+				return err
+			}
+			if head == stoppedHEAD || !onTop {
+				return fmt.Errorf("%s (%s) was not committed; the cherry-pick or merge was abandoned\n"+
+					"\n"+
+					"To resolve:\n"+
+					"  1. Apply it again: git cherry-pick %s, resolve and commit it\n"+
+					"  2. Continue rebranch: rebranch --continue\n"+
+					"  3. Or drop this commit: rebranch --skip\n"+
+					"  4. Or abort rebranch: rebranch --abort", shortSHA(commit.SHA), commitSubject(commit.Message), shortSHA(commit.SHA))
 			}
-			return fmt.Errorf("conflict during cherry-pick of %s (%s)\n"+
-				"\n"+
-				"To resolve:\n"+
-				"  1. Edit conflicted files to resolve conflicts\n"+
-				"  2. Stage resolved files: git add <files>\n"+
-				"  3. Continue rebranch: rebranch --continue\n"+
-				"  4. Or abort rebranch: rebranch --abort\n"+
-				"\n"+
-				"View conflict status: git status", commit.SHA[:7], commit.Message)
 		}
 
-		state.CurrentCommitIdx = i
-		if err := store.SaveState(state); err != nil {
+		message, err := git.GetCommitMessage("HEAD")
+		if err != nil {
 			return err
 		}
+		if message != commit.Message {
+			fmt.Printf("Warning: HEAD is not %s (%s); its message differs from the original commit\n",
+				shortSHA(commit.SHA), commitSubject(commit.Message))
+		}
+		return nil
 	}
 
-	// All commits applied successfully
-	fmt.Printf("Successfully applied %d commits to %s\n",
-		countPickedCommits(state.CommitsToApply), state.TempBranch)
-	fmt.Printf("Review the new branch history and run: rebranch --done\n")
+	unmerged, err := git.UnmergedPaths()
+	if err != nil {
+		return err
+	}
+	if len(unmerged) > 0 {
+		return fmt.Errorf("conflicts are not resolved in:\n"+
+			"  %s\n"+
+			"\n"+
+			"To resolve:\n"+
+			"  1. Edit conflicted files to resolve conflicts\n"+
+			"  2. Stage resolved files: git add <files>\n"+
+			"  3. Continue rebranch: rebranch --continue", strings.Join(unmerged, "\n  "))
+	}
 
-	state.Stage = "done"
-	return store.SaveState(state)
+	// Only staged changes are part of the resolution; anything else may be
+	// half of it, so nothing is committed yet
+	unstaged, err := git.UnstagedPaths()
+	if err != nil {
+		return err
+	}
+	if len(unstaged) > 0 {
+		return fmt.Errorf("changes are not staged in:\n"+
+			"  %s\n"+
+			"\n"+
+			"To resolve:\n"+
+			"  1. Stage the rest of the resolution: git add <files>\n"+
+			"  2. Or discard what is not part of it: git restore <files>, or delete untracked files\n"+
+			"  3. Continue rebranch: rebranch --continue", strings.Join(unstaged, "\n  "))
+	}
+
+	if err := git.CommitPending(); err != nil {
+		return fmt.Errorf("failed to finish %s of %s: %w", pending, shortSHA(commit.SHA), err)
+	}
+
+	return nil
 }
 
-// finishRebranch completes the rebranch by replacing original branch
-func finishRebranch(git GitInterface, store Store) error {
-	// Validate preconditions
-	if err := validateFinish(git, store); err != nil {
-		return err
+// statusRebranch prints the progress of the rebranch and the next valid commands
+func statusRebranch(git GitInterface, store Store) error {
+	if err := git.IsValidRepository(); err != nil {
+		return fmt.Errorf("invalid repository: %w", err)
+	}
+
+	if !store.StateExists() {
+		fmt.Printf("No rebranch operation in progress\n")
+		return nil
 	}
 
 	state, err := store.LoadState()
@@ -219,29 +583,117 @@ func finishRebranch(git GitInterface, store Store) error {
 		return err
 	}
 
-	// Delete original branch
-	if err := git.DeleteBranch(state.SourceBranch); err != nil {
-		return fmt.Errorf("failed to delete original branch %s: %v", state.SourceBranch, err)
+	fmt.Printf("Rebranching %s onto %s", state.SourceBranch, state.BaseBranch)
+	if state.BaseSHA != "" {
+		fmt.Printf(" (%s)", shortSHA(state.BaseSHA))
+	}
+	fmt.Printf("\n")
+	if state.Upstream != "" {
+		fmt.Printf("Only commits after %s\n", state.Upstream)
+	}
+	fmt.Printf("Temp branch: %s\n", state.TempBranch)
+	if state.Worktree != "" {
+		fmt.Printf("Worktree: %s\n", state.Worktree)
 	}
+	fmt.Printf("Stage: %s\n", state.Stage)
 
-	// Rename temp branch to original name
-	if err := git.RenameBranch(state.TempBranch, state.SourceBranch); err != nil {
-		return fmt.Errorf("failed to rename %s to %s: %v", state.TempBranch, state.SourceBranch, err)
+	// Commits added to the source meanwhile have to be folded in first
+	sourceMoved := false
+	if state.SourceSHA != "" && state.Stage != "finishing" {
+		current, err := git.ResolveRevision("refs/heads/" + state.SourceBranch)
+		sourceMoved = err != nil || current != state.SourceSHA
+	}
+	if sourceMoved {
+		fmt.Printf("Warning: %s moved since the rebranch started\n", state.SourceBranch)
 	}
 
-	// Cleanup state
-	if err := store.ClearState(); err != nil {
-		return err
+	// Entries before the current one are done; in the "done" stage all are
+	current := state.CurrentCommitIdx
+	if state.Stage == "done" || state.Stage == "finishing" {
+		current = len(state.CommitsToApply)
+	}
+
+	var applied, remaining []CommitInfo
+	for i, commit := range state.CommitsToApply {
+		switch {
+		case i < current:
+			applied = append(applied, commit)
+		case i > current:
+			remaining = append(remaining, commit)
+		}
+	}
+
+	printEntries := func(title string, commits []CommitInfo) {
+		fmt.Printf("\n%s (%d):\n", title, len(commits))
+		for _, commit := range commits {
+			fmt.Printf("  %s\n", formatPickLine(commit))
+		}
+	}
+
+	printEntries("Done", applied)
+	if current < len(state.CommitsToApply) {
+		commit := state.CommitsToApply[current]
+		switch state.Stage {
+		case "conflicts":
+			fmt.Printf("\nConflicted:\n  %s\n", formatPickLine(commit))
+			picker, err := worktreeGit(git, state)
+			if err != nil {
+				return err
+			}
+			unmerged, err := picker.UnmergedPaths()
+			if err != nil {
+				return err
+			}
+			for _, path := range unmerged {
+				fmt.Printf("    conflict in %s\n", path)
+			}
+		case "editing":
+			fmt.Printf("\nStopped for editing:\n  %s\n", formatPickLine(commit))
+		case "exec-failed":
+			fmt.Printf("\nFailed:\n  %s\n", formatPickLine(commit))
+		case "message-failed":
+			fmt.Printf("\nMessage not written:\n  %s\n", formatPickLine(commit))
+		default:
+			fmt.Printf("\nInterrupted at:\n  %s\n", formatPickLine(commit))
+		}
+	}
+	printEntries("Remaining", remaining)
+
+	fmt.Printf("\nNext:\n")
+	if sourceMoved {
+		fmt.Printf("  • Add the new commits of %s to the pick list: rebranch --fold-new\n", state.SourceBranch)
+	}
+	if state.Worktree != "" && state.Stage != "done" {
+		fmt.Printf("  • Work in the rebranch worktree: cd %s\n", state.Worktree)
+	}
+	switch state.Stage {
+	case "conflicts":
+		fmt.Printf("  • Resolve conflicts, stage them with git add, then: rebranch --continue\n")
+		fmt.Printf("  • Drop this commit: rebranch --skip\n")
+	case "editing":
+		fmt.Printf("  • Amend the commit: git commit --amend\n")
+		fmt.Printf("  • Then: rebranch --continue\n")
+	case "exec-failed":
+		fmt.Printf("  • Fix the problem and amend the commit: git commit --amend\n")
+		fmt.Printf("  • Then: rebranch --continue\n")
+	case "message-failed":
+		fmt.Printf("  • Edit the message again: rebranch --continue\n")
+		fmt.Printf("  • Drop this commit: rebranch --skip\n")
+	case "done":
+		fmt.Printf("  • Replace %s with the new branch: rebranch --done\n", state.SourceBranch)
+	case "finishing":
+		fmt.Printf("  • Finish replacing %s: rebranch --done\n", state.SourceBranch)
+	}
+	if state.Stage != "finishing" {
+		fmt.Printf("  • Cancel: rebranch --abort\n")
 	}
 
-	fmt.Printf("Successfully rebranched %s onto %s\n", state.SourceBranch, state.BaseBranch)
 	return nil
 }
 
-// abortRebranch cancels the operation and cleans up
-func abortRebranch(git GitInterface, store Store) error {
-	// Validate preconditions
-	if err := validateAbort(git, store); err != nil {
+// skipRebranch drops the conflicting commit and resumes with the next one
+func skipRebranch(git GitInterface, editor EditorInterface, store Store) error {
+	if err := validateSkip(git, store); err != nil {
 		return err
 	}
 
@@ -250,33 +702,1031 @@ func abortRebranch(git GitInterface, store Store) error {
 		return err
 	}
 
-	// Switch back to original branch
-	if err := git.CheckoutBranch(state.SourceBranch); err != nil {
+	git, err = worktreeGit(git, state)
+	if err != nil {
 		return err
 	}
 
-	// Delete temp branch
-	if err := git.DeleteBranch(state.TempBranch); err != nil {
-		// Log warning but don't fail
-		fmt.Printf("Warning: failed to delete temp branch %s: %v\n", state.TempBranch, err)
+	// Throw away the conflicted cherry-pick or merge, or the commit whose
+	// message could not be written, along with anything committed on top
+	undo := state.StoppedHEAD
+	if undo == "" {
+		// Rebranches stopped before HEAD was recorded
+		undo = "HEAD"
+		if state.Stage == "message-failed" {
+			undo = "HEAD~1"
+		}
+	}
+	if err := git.ResetHard(undo); err != nil {
+		return err
 	}
 
-	// Clear state
-	if err := store.ClearState(); err != nil {
+	commit := &state.CommitsToApply[state.CurrentCommitIdx]
+	commit.Action = "drop"
+	fmt.Printf("Skipped %s (%s)\n", shortSHA(commit.SHA), commitSubject(commit.Message))
+
+	state.CurrentCommitIdx++
+	state.Stage = "picking"
+	if err := store.SaveState(state); err != nil {
 		return err
 	}
 
-	fmt.Printf("Rebranch aborted\n")
-	return nil
+	return ApplyCherryPicks(git, editor, store, state)
 }
 
-// countPickedCommits counts commits with "pick" action
-func countPickedCommits(commits []CommitInfo) int {
-	count := 0
+// foldNewCommits appends the commits added to the source branch since the
+// rebranch started to the pick list
+func foldNewCommits(git GitInterface, editor EditorInterface, store Store) error {
+	if err := validateFoldNew(git, store); err != nil {
+		return err
+	}
+
+	state, err := store.LoadState()
+	if err != nil {
+		return err
+	}
+
+	current, err := git.ResolveRevision("refs/heads/" + state.SourceBranch)
+	if err != nil {
+		return fmt.Errorf("source branch %s no longer exists: %w", state.SourceBranch, err)
+	}
+	if current == state.SourceSHA {
+		fmt.Printf("%s has not moved; nothing to fold\n", state.SourceBranch)
+		return nil
+	}
+
+	// Only commits added on top can be folded in; a rewrite cannot be
+	isAncestor, err := git.IsAncestor(state.SourceSHA, current)
+	if err != nil {
+		return err
+	}
+	if !isAncestor {
+		return fmt.Errorf("%s was rewritten since the rebranch started (%s is no longer in it)\n"+
+			"\n"+
+			"Its new commits cannot be told apart from the old ones.\n"+
+			"Cancel with rebranch --abort and start again", state.SourceBranch, shortSHA(state.SourceSHA))
+	}
+
+	commits, err := git.GetCommitsBetween(state.SourceSHA, current)
+	if err != nil {
+		return err
+	}
+	commits = selectMergeCommits(commits, "linearize")
+
+	fmt.Printf("Folding %d new commits from %s into the pick list:\n", len(commits), state.SourceBranch)
 	for _, commit := range commits {
-		if commit.Action == "pick" {
-			count++
+		fmt.Printf("  %s\n", formatPickLine(commit))
+	}
+
+	applied := len(state.CommitsToApply)
+	state.CommitsToApply = append(state.CommitsToApply, commits...)
+	state.SourceSHA = current
+
+	// Stopped anywhere else, the new commits follow once the rebranch continues
+	if state.Stage != "done" {
+		if err := store.SaveState(state); err != nil {
+			return err
 		}
+		fmt.Printf("They will be applied after the remaining commits; run: rebranch --continue\n")
+		return nil
 	}
-	return count
+
+	state.CurrentCommitIdx = applied
+	state.Stage = "picking"
+	if err := store.SaveState(state); err != nil {
+		return err
+	}
+
+	picker, err := worktreeGit(git, state)
+	if err != nil {
+		return err
+	}
+	return ApplyCherryPicks(picker, editor, store, state)
 }
+
+// ApplyCherryPicks applies remaining commits from current index
+func ApplyCherryPicks(git GitInterface, editor EditorInterface, store Store, state *RebranchState) error {
+	for i := state.CurrentCommitIdx; i < len(state.CommitsToApply); i++ {
+		commit := state.CommitsToApply[i]
+		if commit.Action == "drop" {
+			continue
+		}
+
+		if commit.Action == "exec" {
+			fmt.Printf("Executing: %s\n", commit.Command)
+			state.CurrentCommitIdx = i
+			if err := git.Exec(commit.Command); err != nil {
+				state.Stage = "exec-failed"
+				if saveErr := store.SaveState(state); saveErr != nil {
+					return fmt.Errorf("exec failed and could not save state: %v", saveErr)
+				}
+				return fmt.Errorf("exec failed: %s (%v)\n"+
+					"\n"+
+					"To resolve:\n"+
+					"  1. Fix the problem and amend the commit: git commit --amend\n"+
+					"  2. Continue rebranch: rebranch --continue\n"+
+					"  3. Or abort rebranch: rebranch --abort%s", commit.Command, err, worktreeNote(state))
+			}
+			if err := store.SaveState(state); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// label, reset and merge recreate the shape of merged history
+		if commit.Action == "label" {
+			head, err := git.ResolveRevision("HEAD")
+			if err != nil {
+				return err
+			}
+			if state.Labels == nil {
+				state.Labels = make(map[string]string)
+			}
+			state.Labels[commit.Label] = head
+			state.CurrentCommitIdx = i
+			if err := store.SaveState(state); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if commit.Action == "reset" {
+			rev, err := resolveLabel(state, commit.Label)
+			if err != nil {
+				return err
+			}
+			if err := git.ResetHard(rev); err != nil {
+				return err
+			}
+			state.CurrentCommitIdx = i
+			if err := store.SaveState(state); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if commit.Action == "merge" {
+			var revs []string
+			for _, label := range strings.Fields(commit.Label) {
+				rev, err := resolveLabel(state, label)
+				if err != nil {
+					return err
+				}
+				revs = append(revs, rev)
+			}
+			state.CurrentCommitIdx = i
+			head, err := git.ResolveRevision("HEAD")
+			if err != nil {
+				return err
+			}
+			if err := git.Merge(commit.Message, revs...); err != nil {
+				state.StoppedHEAD = head
+				state.Stage = "conflicts"
+				if saveErr := store.SaveState(state); saveErr != nil {
+					return fmt.Errorf("merge failed and could not save state: %v", saveErr)
+				}
+				return fmt.Errorf("conflict during merge of %s (%s)\n"+
+					"\n"+
+					"To resolve:\n"+
+					"  1. Edit conflicted files to resolve conflicts\n"+
+					"  2. Stage resolved files: git add <files>\n"+
+					"  3. Continue rebranch: rebranch --continue\n"+
+					"  4. Or drop this merge: rebranch --skip\n"+
+					"  5. Or abort rebranch: rebranch --abort\n"+
+					"\n"+
+					"View conflict status: git status%s", commit.Label, commitSubject(commit.Message), worktreeNote(state))
+			}
+			if err := store.SaveState(state); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// Remember where the branch should point; refs only move on --done
+		if commit.Action == "update-ref" {
+			head, err := git.ResolveRevision("HEAD")
+			if err != nil {
+				return err
+			}
+			for j := range state.StackBranches {
+				if "refs/heads/"+state.StackBranches[j].Name == commit.Ref {
+					state.StackBranches[j].NewSHA = head
+				}
+			}
+			state.CurrentCommitIdx = i
+			if err := store.SaveState(state); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// A resolution of conflicts has to be committed on top of this
+		head, err := git.ResolveRevision("HEAD")
+		if err != nil {
+			return err
+		}
+		err = git.CherryPick(commit.SHA)
+		if err != nil {
+			state.CurrentCommitIdx = i
+			state.StoppedHEAD = head
+			state.Stage = "conflicts"
+			if saveErr := store.SaveState(state); saveErr != nil {
+				return fmt.Errorf("cherry-pick failed and could not save state: %v", saveErr)
+			}
+			return fmt.Errorf("conflict during cherry-pick of %s (%s)\n"+
+				"\n"+
+				"To resolve:\n"+
+				"  1. Edit conflicted files to resolve conflicts\n"+
+				"  2. Stage resolved files: git add <files>\n"+
+				"  3. Continue rebranch: rebranch --continue\n"+
+				"  4. Or drop this commit: rebranch --skip\n"+
+				"  5. Or abort rebranch: rebranch --abort\n"+
+				"\n"+
+				"View conflict status: git status%s", commit.SHA[:7], commit.Message, worktreeNote(state))
+		}
+
+		state.CurrentCommitIdx = i
+		if err := finishCommit(git, editor, commit); err != nil {
+			state.StoppedHEAD = head
+			return stopForMessage(store, state, commit, err)
+		}
+
+		if commit.Action == "edit" {
+			state.Stage = "editing"
+			if err := store.SaveState(state); err != nil {
+				return err
+			}
+			fmt.Printf("Stopped at %s (%s)\n", shortSHA(commit.SHA), commitSubject(commit.Message))
+			fmt.Printf("You can amend the commit now, with: git commit --amend\n")
+			fmt.Printf("Once you are satisfied with your changes, run: rebranch --continue\n")
+			if note := worktreeNote(state); note != "" {
+				fmt.Printf("%s\n", strings.TrimSpace(note))
+			}
+			return nil
+		}
+
+		if err := store.SaveState(state); err != nil {
+			return err
+		}
+	}
+
+	// All commits applied successfully
+	fmt.Printf("Successfully applied %d commits to %s\n",
+		countAppliedCommits(state.CommitsToApply), state.TempBranch)
+	fmt.Printf("Review the new branch history and run: rebranch --done\n")
+
+	state.Stage = "done"
+	return store.SaveState(state)
+}
+
+// finishRebranch completes the rebranch by replacing original branch. The
+// source branch, stacked branches and backup ref move in one transaction, and
+// every step can be rerun, so an interrupted --done is finished by running it
+// again.
+func finishRebranch(git GitInterface, store Store) error {
+	// Validate preconditions
+	if err := validateFinish(git, store); err != nil {
+		return err
+	}
+
+	state, err := store.LoadState()
+	if err != nil {
+		return err
+	}
+
+	if state.Stage == "finishing" {
+		fmt.Printf("Resuming the interrupted rebranch --done\n")
+	} else {
+		// The temp branch can only be checked out here once its worktree is gone
+		if state.Worktree != "" {
+			if err := git.RemoveWorktree(state.Worktree); err != nil {
+				return err
+			}
+			state.Worktree = ""
+			if err := store.SaveState(state); err != nil {
+				return err
+			}
+			if err := git.CheckoutBranch(state.TempBranch); err != nil {
+				return fmt.Errorf("%v\n"+
+					"\n"+
+					"The rebranch worktree was removed. Check out %s yourself,\n"+
+					"then run rebranch --done again", err, state.TempBranch)
+			}
+		}
+
+		// Record what every ref is expected to move from and to before
+		// touching any of them. SourceSHA is pinned at start.
+		if state.SourceSHA == "" {
+			if state.SourceSHA, err = git.ResolveRevision("refs/heads/" + state.SourceBranch); err != nil {
+				return err
+			}
+		}
+		if state.NewSHA, err = git.ResolveRevision("refs/heads/" + state.TempBranch); err != nil {
+			return err
+		}
+		if state.BackupRef, err = nextBackupRef(git, state.SourceBranch); err != nil {
+			return err
+		}
+		state.Stage = "finishing"
+		if err := store.SaveState(state); err != nil {
+			return err
+		}
+	}
+
+	if err := replaceSourceBranch(git, state); err != nil {
+		// Nothing was moved, so the rebranch can still be aborted or extended
+		if !refsReplaced(git, state) {
+			state.Stage = "done"
+			if saveErr := store.SaveState(state); saveErr != nil {
+				return fmt.Errorf("%v\nand could not save state: %v", err, saveErr)
+			}
+		}
+		return err
+	}
+
+	// Cleanup state
+	if err := store.ClearState(); err != nil {
+		return err
+	}
+
+	fmt.Printf("Successfully rebranched %s onto %s\n", state.SourceBranch, state.BaseBranch)
+	fmt.Printf("The old %s is saved as %s; restore it with: rebranch --undo\n", state.SourceBranch, state.BackupRef)
+
+	if err := pruneBackups(git, state.SourceBranch); err != nil {
+		fmt.Printf("Warning: failed to prune old backups of %s: %v\n", state.SourceBranch, err)
+	}
+	return nil
+}
+
+// refsReplaced reports whether the ref transaction of --done went through.
+// The backup ref is created by that transaction, so it shows.
+func refsReplaced(git GitInterface, state *RebranchState) bool {
+	if state.BackupRef == "" {
+		return false
+	}
+	_, err := git.ResolveRevision(state.BackupRef)
+	return err == nil
+}
+
+// replaceSourceBranch moves the refs recorded by finishRebranch, switches
+// HEAD from the temp branch to the source branch and deletes the temp branch.
+// Steps that already happened are skipped. The source ref is moved in place,
+// never deleted, so its branch.<name>.* config (upstream, description) stays.
+func replaceSourceBranch(git GitInterface, state *RebranchState) error {
+	sourceRef := "refs/heads/" + state.SourceBranch
+	tempRef := "refs/heads/" + state.TempBranch
+
+	if !refsReplaced(git, state) {
+		updates, err := stackRefUpdates(state)
+		if err != nil {
+			return err
+		}
+		updates = append(updates,
+			RefUpdate{Ref: state.BackupRef, NewSHA: state.SourceSHA},
+			RefUpdate{Ref: sourceRef, NewSHA: state.NewSHA, OldSHA: state.SourceSHA})
+
+		message := fmt.Sprintf("rebranch: %s onto %s", state.SourceBranch, state.BaseBranch)
+		if err := git.UpdateRefs(message, updates); err != nil {
+			return fmt.Errorf("%v\n"+
+				"\n"+
+				"No branch was changed. If %s or a stacked branch moved since the\n"+
+				"rebranch started, cancel with rebranch --abort and start again", err, state.SourceBranch)
+		}
+		for _, branch := range state.StackBranches {
+			fmt.Printf("Moved %s to %s\n", branch.Name, shortSHA(branch.NewSHA))
+		}
+	}
+
+	// HEAD still names the temp branch unless a previous run got past this
+	if head, err := git.GetCurrentBranch(); err == nil && head == state.TempBranch {
+		if err := git.SetHeadBranch(state.SourceBranch); err != nil {
+			return err
+		}
+	}
+
+	if git.BranchExists(state.TempBranch) {
+		if err := git.DeleteRef(tempRef, state.NewSHA); err != nil {
+			return fmt.Errorf("failed to delete temp branch %s: %v", state.TempBranch, err)
+		}
+	}
+
+	return nil
+}
+
+// abortRebranch cancels the operation and cleans up
+func abortRebranch(git GitInterface, store Store) error {
+	// Validate preconditions
+	if err := validateAbort(git, store); err != nil {
+		return err
+	}
+
+	state, err := store.LoadState()
+	if err != nil {
+		return err
+	}
+
+	// Discard the rebranch worktree along with any unfinished pick in it
+	if state.Worktree != "" {
+		if err := git.RemoveWorktree(state.Worktree); err != nil {
+			return err
+		}
+	}
+
+	// Switch back to original branch
+	if err := git.CheckoutBranch(state.SourceBranch); err != nil {
+		return err
+	}
+
+	// Delete temp branch
+	if err := git.DeleteBranch(state.TempBranch); err != nil {
+		// Log warning but don't fail
+		fmt.Printf("Warning: failed to delete temp branch %s: %v\n", state.TempBranch, err)
+	}
+
+	// Clear state
+	if err := store.ClearState(); err != nil {
+		return err
+	}
+
+	fmt.Printf("Rebranch aborted\n")
+	return nil
+}
+
+// createTempBranch creates a temp branch at baseSHA. Rebranches in other
+// worktrees of the repository may start in the same second, so the branch is
+// only created if the name is free.
+func createTempBranch(git GitInterface, baseSHA string) (string, error) {
+	timestamp := time.Now().Unix()
+	for {
+		tempBranch := fmt.Sprintf("%s%d", TempBranchPrefix, timestamp)
+		err := git.UpdateRef("refs/heads/"+tempBranch, baseSHA, "")
+		if err == nil {
+			return tempBranch, nil
+		}
+		if !git.BranchExists(tempBranch) {
+			return "", fmt.Errorf("failed to create temp branch %s: %w", tempBranch, err)
+		}
+		timestamp++
+	}
+}
+
+// otherWorktreeTempBranches returns the temp branches recorded in the state
+// files of the repository's other worktrees
+func otherWorktreeTempBranches(git GitInterface) map[string]bool {
+	stateFiles, _ := filepath.Glob(filepath.Join(git.GetCommonDir(), "worktrees", "*", StateFileName))
+	stateFiles = append(stateFiles, filepath.Join(git.GetCommonDir(), StateFileName))
+
+	temps := make(map[string]bool)
+	for _, path := range stateFiles {
+		if filepath.Dir(path) == git.GetGitDir() {
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		var state RebranchState
+		if json.Unmarshal(data, &state) == nil && state.TempBranch != "" {
+			temps[state.TempBranch] = true
+		}
+	}
+	return temps
+}
+
+// repairRebranch rebuilds an unreadable or missing state file from the temp
+// branch. The pick list cannot be recovered, so the rebuilt state is "done":
+// the temp branch can be reviewed, then finished or aborted.
+func repairRebranch(git GitInterface, store Store) error {
+	if err := git.IsValidRepository(); err != nil {
+		return fmt.Errorf("invalid repository: %w", err)
+	}
+
+	if store.StateExists() {
+		if _, err := store.LoadState(); err == nil {
+			fmt.Printf("The rebranch state is readable; nothing to repair\n")
+			return nil
+		}
+	}
+
+	tips, err := git.GetBranchTips()
+	if err != nil {
+		return err
+	}
+	// Temp branches of rebranches running in other worktrees are not ours
+	others := otherWorktreeTempBranches(git)
+	var temps []string
+	for name := range tips {
+		if strings.HasPrefix(name, TempBranchPrefix) && !others[name] {
+			temps = append(temps, name)
+		}
+	}
+	if len(temps) == 0 {
+		if !store.StateExists() {
+			return errors.New("no rebranch operation to repair")
+		}
+		fmt.Printf("No temp branch found; removing the unreadable state file\n")
+		return store.ClearState()
+	}
+
+	// Temp branch names end in their creation time
+	sort.Strings(temps)
+	tempBranch := temps[len(temps)-1]
+	if len(temps) > 1 {
+		fmt.Printf("Found %d temp branches; using the newest, %s\n", len(temps), tempBranch)
+	}
+
+	state := &RebranchState{
+		BaseBranch: "(unknown)",
+		TempBranch: tempBranch,
+		Stage:      "done",
+	}
+	if worktree := filepath.Join(git.GetCommonDir(), "rebranch", tempBranch); dirExists(worktree) {
+		state.Worktree = worktree
+	}
+
+	// Without --worktree the source is the branch the temp branch was
+	// checked out from
+	state.SourceBranch, err = git.GetCurrentBranch()
+	if err != nil || state.SourceBranch == tempBranch {
+		state.SourceBranch, err = git.GetPreviousBranch()
+	}
+	if err != nil || state.SourceBranch == "" || strings.HasPrefix(state.SourceBranch, TempBranchPrefix) {
+		return fmt.Errorf("cannot tell which branch %s was rebranching\n"+
+			"\n"+
+			"Check out the original branch, then run rebranch --repair again.\n"+
+			"Or delete the temp branch: git branch -D %s", tempBranch, tempBranch)
+	}
+	if state.SourceSHA, err = git.ResolveRevision("refs/heads/" + state.SourceBranch); err != nil {
+		return fmt.Errorf("source branch %s not found: %w", state.SourceBranch, err)
+	}
+
+	// A pick stopped halfway has to be finished by hand first
+	picker, err := worktreeGit(git, state)
+	if err != nil {
+		return err
+	}
+	if pending := picker.PendingCommit(); pending != "" {
+		return fmt.Errorf("a %s is in progress on %s\n"+
+			"\n"+
+			"Finish it (git %s --continue) or abandon it (git %s --abort),\n"+
+			"then run rebranch --repair again", pending, tempBranch, pending, pending)
+	}
+
+	if err := store.SaveState(state); err != nil {
+		return err
+	}
+
+	fmt.Printf("Rebuilt the rebranch state: %s replaces %s\n", tempBranch, state.SourceBranch)
+	fmt.Printf("The pick list could not be recovered. Review %s, then run\n", tempBranch)
+	fmt.Printf("rebranch --done to replace %s with it, or rebranch --abort\n", state.SourceBranch)
+	return nil
+}
+
+// dirExists reports whether path is an existing directory
+func dirExists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+// worktreeGit returns the Git instance the commits are applied with: the
+// rebranch worktree when there is one, git otherwise
+func worktreeGit(git GitInterface, state *RebranchState) (GitInterface, error) {
+	if state.Worktree == "" {
+		return git, nil
+	}
+	if _, err := os.Stat(state.Worktree); err != nil {
+		return nil, fmt.Errorf("rebranch worktree %s is missing: %v\n"+
+			"\n"+
+			"Cancel with rebranch --abort and start again", state.Worktree, err)
+	}
+	return NewGitInPath(state.Worktree)
+}
+
+// worktreeNote tells where to work when the commits are applied in a worktree
+func worktreeNote(state *RebranchState) string {
+	if state.Worktree == "" {
+		return ""
+	}
+	return "\n\n" +
+		"The new branch is checked out in a separate worktree:\n" +
+		"  cd " + state.Worktree + "\n" +
+		"Run rebranch itself from your original checkout"
+}
+
+// dryRunPicks replays the default pick list in memory and reports whether
+// each commit applies cleanly, becomes empty or conflicts. Conflicting commits
+// are left out of the simulated branch, as if skipped.
+func dryRunPicks(git GitInterface, baseSHA string, commits []CommitInfo) error {
+	fmt.Printf("\nDry run onto %s; nothing will be changed:\n", shortSHA(baseSHA))
+
+	head := baseSHA
+	var clean, empty, conflicted int
+	for _, commit := range commits {
+		prefix := fmt.Sprintf("  %s %s", shortSHA(commit.SHA), commitSubject(commit.Message))
+		if commit.Action == "drop" {
+			fmt.Printf("%s: dropped\n", prefix)
+			continue
+		}
+
+		result, conflicts, err := git.SimulateCherryPick(head, commit.SHA)
+		if err != nil {
+			return fmt.Errorf("failed to simulate %s: %w", shortSHA(commit.SHA), err)
+		}
+		switch {
+		case len(conflicts) > 0:
+			conflicted++
+			fmt.Printf("%s: conflicts in %s\n", prefix, strings.Join(conflicts, ", "))
+		case result == head:
+			empty++
+			fmt.Printf("%s: becomes empty\n", prefix)
+		default:
+			clean++
+			head = result
+			fmt.Printf("%s: applies cleanly\n", prefix)
+		}
+	}
+
+	fmt.Printf("\n%d clean, %d empty, %d conflicting\n", clean, empty, conflicted)
+	return nil
+}
+
+// findSquashMergedPrefix returns the length of the longest prefix of commits,
+// up to MaxSquashMergedPrefix, whose combined changes are already present in
+// base. A squash-merged parent branch leaves no per-commit patch-id match, but
+// its cumulative diff is there.
+func findSquashMergedPrefix(git GitInterface, base string, commits []CommitInfo) (int, error) {
+	if len(commits) == 0 {
+		return 0, nil
+	}
+
+	// Only a linear prefix can be compared as one diff
+	limit := min(len(commits), MaxSquashMergedPrefix)
+	for i, commit := range commits[:limit] {
+		if len(commit.Parents) > 1 {
+			limit = i
+			break
+		}
+	}
+
+	// A root commit, from history unrelated to the base, cannot have been
+	// squash-merged into it
+	if len(commits[0].Parents) == 0 {
+		return 0, nil
+	}
+
+	from := commits[0].SHA + "^"
+	for n := limit; n > 0; n-- {
+		applied, err := git.HasChangesApplied(base, from, commits[n-1].SHA)
+		if err != nil {
+			return 0, fmt.Errorf("failed to check for squash-merged commits: %w", err)
+		}
+		if applied {
+			return n, nil
+		}
+	}
+
+	return 0, nil
+}
+
+// findStackBranches returns the local branches, other than the source
+// branch, whose tips are among the commits being rebranched
+func findStackBranches(git GitInterface, sourceBranch, baseBranch string, commits []CommitInfo) ([]StackBranch, error) {
+	tips, err := git.GetBranchTips()
+	if err != nil {
+		return nil, err
+	}
+
+	inRange := make(map[string]bool, len(commits))
+	for _, commit := range commits {
+		inRange[commit.SHA] = true
+	}
+
+	var stack []StackBranch
+	for name, sha := range tips {
+		if name == sourceBranch || name == baseBranch || strings.HasPrefix(name, TempBranchPrefix) {
+			continue
+		}
+		if inRange[sha] {
+			stack = append(stack, StackBranch{Name: name, OldSHA: sha})
+		}
+	}
+
+	// Keep the output stable, bottom of the stack first
+	sort.Slice(stack, func(i, j int) bool {
+		return commitIndex(commits, stack[i].OldSHA) < commitIndex(commits, stack[j].OldSHA)
+	})
+
+	return stack, nil
+}
+
+// insertUpdateRefs returns commits with an update-ref entry after the tip
+// commit of each stacked branch
+func insertUpdateRefs(commits []CommitInfo, stack []StackBranch) []CommitInfo {
+	if len(stack) == 0 {
+		return commits
+	}
+
+	var result []CommitInfo
+	for _, commit := range commits {
+		result = append(result, commit)
+		for _, branch := range stack {
+			if branch.OldSHA == commit.SHA {
+				result = append(result, CommitInfo{
+					SHA:    branch.OldSHA,
+					Action: "update-ref",
+					Ref:    "refs/heads/" + branch.Name,
+				})
+			}
+		}
+	}
+	return result
+}
+
+// selectedStackBranches returns the stacked branches of the update-ref
+// entries kept in the pick file
+func selectedStackBranches(commits []CommitInfo) []StackBranch {
+	var stack []StackBranch
+	for _, commit := range commits {
+		if commit.Action == "update-ref" {
+			stack = append(stack, StackBranch{
+				Name:   strings.TrimPrefix(commit.Ref, "refs/heads/"),
+				OldSHA: commit.SHA,
+			})
+		}
+	}
+	return stack
+}
+
+// stackRefUpdates returns the ref updates that point each stacked branch at
+// the commit that was HEAD when its update-ref line was reached
+func stackRefUpdates(state *RebranchState) ([]RefUpdate, error) {
+	var updates []RefUpdate
+	for _, branch := range state.StackBranches {
+		if branch.NewSHA == "" {
+			return nil, fmt.Errorf("stacked branch %s was never reached in the pick list", branch.Name)
+		}
+		updates = append(updates, RefUpdate{
+			Ref:    "refs/heads/" + branch.Name,
+			NewSHA: branch.NewSHA,
+			OldSHA: branch.OldSHA,
+		})
+	}
+	return updates, nil
+}
+
+// commitIndex returns the position of sha in commits, or -1
+func commitIndex(commits []CommitInfo, sha string) int {
+	for i, commit := range commits {
+		if commit.SHA == sha {
+			return i
+		}
+	}
+	return -1
+}
+
+// stopForMessage stops the rebranch at commit, whose cherry-pick landed but
+// whose reword, squash or fixup failed, so --continue can retry it
+func stopForMessage(store Store, state *RebranchState, commit CommitInfo, cause error) error {
+	state.Stage = "message-failed"
+	if err := store.SaveState(state); err != nil {
+		return fmt.Errorf("%v\nand could not save state: %v", cause, err)
+	}
+	return fmt.Errorf("%v\n"+
+		"\n"+
+		"%s (%s) is applied, but its %s is not.\n"+
+		"To resolve:\n"+
+		"  1. Edit the message again: rebranch --continue\n"+
+		"  2. Or drop this commit: rebranch --skip\n"+
+		"  3. Or abort rebranch: rebranch --abort%s", cause, shortSHA(commit.SHA), commitSubject(commit.Message), commit.Action, worktreeNote(state))
+}
+
+// finishCommit completes the action of a commit that was just cherry-picked
+func finishCommit(git GitInterface, editor EditorInterface, commit CommitInfo) error {
+	messageFilePath := GetMessageFilePath(git.GetGitDir())
+
+	switch commit.Action {
+	case "reword":
+		message, err := git.GetCommitMessage("HEAD")
+		if err != nil {
+			return err
+		}
+		message, err = EditCommitMessage(editor, messageFilePath, message)
+		if err != nil {
+			return fmt.Errorf("failed to reword %s: %w", shortSHA(commit.SHA), err)
+		}
+		return git.AmendCommit(message)
+	case "squash":
+		previous, err := git.GetCommitMessage("HEAD~1")
+		if err != nil {
+			return err
+		}
+		current, err := git.GetCommitMessage("HEAD")
+		if err != nil {
+			return err
+		}
+		message := "# This is a combination of 2 commits.\n" +
+			"# This is the 1st commit message:\n\n" + previous + "\n\n" +
+			"# This is the commit message #2:\n\n" + current + "\n"
+		message, err = EditCommitMessage(editor, messageFilePath, message)
+		if err != nil {
+			return fmt.Errorf("failed to squash %s: %w", shortSHA(commit.SHA), err)
+		}
+		return git.SquashHead(message)
+	case "fixup":
+		return git.FixupHead()
+	}
+
+	return nil
+}
+
+// insertExecCommands returns commits with an exec entry for each command
+// after every commit that will be applied
+func insertExecCommands(commits []CommitInfo, commands []string) []CommitInfo {
+	if len(commands) == 0 {
+		return commits
+	}
+
+	var result []CommitInfo
+	for _, commit := range commits {
+		result = append(result, commit)
+		switch commit.Action {
+		case "drop", "update-ref", "label", "reset":
+			continue
+		}
+		for _, command := range commands {
+			result = append(result, CommitInfo{Action: "exec", Command: command})
+		}
+	}
+	return result
+}
+
+// countAppliedCommits counts commits that are not dropped
+func countAppliedCommits(commits []CommitInfo) int {
+	count := 0
+	for _, commit := range commits {
+		switch commit.Action {
+		case "drop", "exec", "update-ref", "label", "reset":
+		default:
+			count++
+		}
+	}
+	return count
+}
+
+// selectMergeCommits applies the --merges mode to the commits of the range.
+// linearize keeps every non-merge commit, skip drops the commits merges
+// brought in, and both list merge commits as dropped. rebase-merges keeps them
+// all for rebaseMergesScript.
+func selectMergeCommits(commits []CommitInfo, mode string) []CommitInfo {
+	if mode == "rebase-merges" || len(commits) == 0 {
+		return commits
+	}
+
+	// Commits are ordered parents first, so the last one is the tip
+	firstParent := make(map[string]bool)
+	if mode == "skip" {
+		parentOf := make(map[string]string, len(commits))
+		for _, commit := range commits {
+			if len(commit.Parents) > 0 {
+				parentOf[commit.SHA] = commit.Parents[0]
+			} else {
+				parentOf[commit.SHA] = ""
+			}
+		}
+		for sha := commits[len(commits)-1].SHA; sha != ""; {
+			parent, inRange := parentOf[sha]
+			if !inRange {
+				break
+			}
+			firstParent[sha] = true
+			sha = parent
+		}
+	}
+
+	var selected []CommitInfo
+	for _, commit := range commits {
+		// Still listed, so the user sees what is left out and can pick it
+		if mode == "skip" && !firstParent[commit.SHA] {
+			commit.MergedIn = true
+			commit.Action = "drop"
+		}
+		if len(commit.Parents) > 1 {
+			commit.Action = "drop"
+		}
+		selected = append(selected, commit)
+	}
+	return selected
+}
+
+// rebaseMergesScript turns the commits of the range into label, reset and
+// merge entries that recreate its merges, like git rebase --rebase-merges.
+// Each side branch is listed before the merge that brings it in.
+func rebaseMergesScript(commits []CommitInfo) []CommitInfo {
+	if len(commits) == 0 {
+		return commits
+	}
+
+	bySHA := make(map[string]CommitInfo, len(commits))
+	for _, commit := range commits {
+		bySHA[commit.SHA] = commit
+	}
+
+	// Depth-first from the tip, first parents before merged-in parents
+	var order []CommitInfo
+	visited := make(map[string]bool, len(commits))
+	var visit func(sha string)
+	visit = func(sha string) {
+		commit, inRange := bySHA[sha]
+		if !inRange || visited[sha] {
+			return
+		}
+		visited[sha] = true
+		for _, parent := range commit.Parents {
+			visit(parent)
+		}
+		order = append(order, commit)
+	}
+	for i := len(commits) - 1; i >= 0; i-- {
+		visit(commits[i].SHA)
+	}
+
+	// The commit each entry has to be applied on top of
+	ontoOf := func(commit CommitInfo) string {
+		if len(commit.Parents) > 0 {
+			if _, inRange := bySHA[commit.Parents[0]]; inRange {
+				return commit.Parents[0]
+			}
+		}
+		return "onto"
+	}
+	labelOf := func(sha string) string {
+		if sha == "onto" {
+			return sha
+		}
+		return shortSHA(sha)
+	}
+
+	// Label every commit that is reset to or merged later on
+	needsLabel := make(map[string]bool)
+	current := "onto"
+	for _, commit := range order {
+		if parent := ontoOf(commit); parent != current {
+			needsLabel[parent] = true
+		}
+		if len(commit.Parents) > 1 {
+			for _, parent := range commit.Parents[1:] {
+				if _, inRange := bySHA[parent]; inRange {
+					needsLabel[parent] = true
+				}
+			}
+		}
+		current = commit.SHA
+	}
+
+	var script []CommitInfo
+	if needsLabel["onto"] {
+		script = append(script, CommitInfo{Action: "label", Label: "onto"})
+	}
+	current = "onto"
+	for _, commit := range order {
+		if parent := ontoOf(commit); parent != current {
+			script = append(script, CommitInfo{Action: "reset", Label: labelOf(parent)})
+		}
+		if len(commit.Parents) > 1 {
+			var merged []string
+			for _, parent := range commit.Parents[1:] {
+				merged = append(merged, labelOf(parent))
+			}
+			commit.Action = "merge"
+			commit.Label = strings.Join(merged, " ")
+		}
+		script = append(script, commit)
+		if needsLabel[commit.SHA] {
+			script = append(script, CommitInfo{Action: "label", Label: labelOf(commit.SHA)})
+		}
+		current = commit.SHA
+	}
+
+	return script
+}
+
+// resolveLabel returns the commit recorded for label. onto without a label
+// entry is where the new branch started, and a revision outside the range is
+// merged or reset to directly.
+func resolveLabel(state *RebranchState, label string) (string, error) {
+	if sha, ok := state.Labels[label]; ok {
+		return sha, nil
+	}
+	if label == "onto" {
+		if state.BaseSHA != "" {
+			return state.BaseSHA, nil
+		}
+		return state.BaseBranch, nil
+	}
+	if inRangeCommit(label, state.CommitsToApply) {
+		return "", fmt.Errorf("label %s was never recorded; the rebranched commit it names has no new position\n"+
+			"\n"+
+			"Abort with: rebranch --abort", label)
+	}
+	return label, nil
+}
\ No newline at end of file
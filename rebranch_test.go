@@ -1,9 +1,13 @@
 package rebranch_test
 
 import (
+	"errors"
+	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
 	"strings"
 	"testing"
 
@@ -445,6 +449,2262 @@ func TestInteractiveCommitSelection(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestAlreadyMergedCommitsPreDropped(t *testing.T) {
+	repoPath, cleanup := setupRebranchTestRepo(t)
+	defer cleanup()
+
+	originalDir, err := os.Getwd()
+	require.NoError(t, err)
+	defer os.Chdir(originalDir)
+	require.NoError(t, os.Chdir(repoPath))
+
+	// Simulate a merge bot rewriting "Add feature 1" onto main
+	cmd := exec.Command("git", "checkout", "main")
+	cmd.Dir = repoPath
+	require.NoError(t, cmd.Run())
+	require.NoError(t, createCommitInRepo(repoPath, "main.txt", "Main content", "Main branch work"))
+	cmd = exec.Command("git", "cherry-pick", "feature~2")
+	cmd.Dir = repoPath
+	require.NoError(t, cmd.Run())
+	cmd = exec.Command("git", "checkout", "feature")
+	cmd.Dir = repoPath
+	require.NoError(t, cmd.Run())
+
+	// Capture the generated pick file without modifying it
+	var pickFile string
+	editor := &MockEditor{
+		ModifyFunc: func(filePath string) error {
+			data, err := os.ReadFile(filePath)
+			pickFile = string(data)
+			return err
+		},
+	}
+
+	err = rebranch.RunCmd([]string{"main"}, rebranch.Options{Editor: editor})
+	require.NoError(t, err)
+
+	assert.Regexp(t, `(?m)^drop [0-9a-f]{7} Add feature 1 # already upstream as [0-9a-f]{7}$`, pickFile)
+	assert.Regexp(t, `(?m)^pick [0-9a-f]{7} Add feature 2$`, pickFile)
+	assert.Regexp(t, `(?m)^pick [0-9a-f]{7} Add feature 3$`, pickFile)
+
+	store, err := rebranch.NewFileStoreInPath(repoPath)
+	require.NoError(t, err)
+	state, err := store.LoadState()
+	require.NoError(t, err)
+	require.Len(t, state.CommitsToApply, 3)
+	assert.Equal(t, "drop", state.CommitsToApply[0].Action)
+	assert.NotEmpty(t, state.CommitsToApply[0].UpstreamSHA)
+
+	err = rebranch.RunCmd([]string{"--done"}, rebranch.Options{})
+	require.NoError(t, err)
+
+	// feature1.txt comes from main, the remaining commits were applied on top
+	cmd = exec.Command("git", "log", "--format=%s", "main..feature")
+	cmd.Dir = repoPath
+	output, err := cmd.Output()
+	require.NoError(t, err)
+	assert.Equal(t, "Add feature 3\nAdd feature 2\n", string(output))
+}
+
+func TestSquashMergedParentPreDropped(t *testing.T) {
+	repoPath, cleanup := setupRebranchTestRepo(t)
+	defer cleanup()
+
+	originalDir, err := os.Getwd()
+	require.NoError(t, err)
+	defer os.Chdir(originalDir)
+	require.NoError(t, os.Chdir(repoPath))
+
+	// Squash-merge the first two feature commits into main as a single commit
+	cmd := exec.Command("git", "checkout", "main")
+	cmd.Dir = repoPath
+	require.NoError(t, cmd.Run())
+	cmd = exec.Command("git", "checkout", "feature~1", "--", "feature1.txt", "feature2.txt")
+	cmd.Dir = repoPath
+	require.NoError(t, cmd.Run())
+	cmd = exec.Command("git", "commit", "-m", "Add features 1 and 2 (squashed)")
+	cmd.Dir = repoPath
+	require.NoError(t, cmd.Run())
+	cmd = exec.Command("git", "checkout", "feature")
+	cmd.Dir = repoPath
+	require.NoError(t, cmd.Run())
+
+	var pickFile string
+	editor := &MockEditor{
+		ModifyFunc: func(filePath string) error {
+			data, err := os.ReadFile(filePath)
+			pickFile = string(data)
+			return err
+		},
+	}
+
+	err = rebranch.RunCmd([]string{"main"}, rebranch.Options{Editor: editor})
+	require.NoError(t, err)
+
+	assert.Contains(t, pickFile, "# The first 2 commits are pre-marked as drop")
+	assert.Regexp(t, `(?m)^drop [0-9a-f]{7} Add feature 1 # squash-merged upstream$`, pickFile)
+	assert.Regexp(t, `(?m)^drop [0-9a-f]{7} Add feature 2 # squash-merged upstream$`, pickFile)
+	assert.Regexp(t, `(?m)^pick [0-9a-f]{7} Add feature 3$`, pickFile)
+
+	err = rebranch.RunCmd([]string{"--done"}, rebranch.Options{})
+	require.NoError(t, err)
+
+	cmd = exec.Command("git", "log", "--format=%s", "main..feature")
+	cmd.Dir = repoPath
+	output, err := cmd.Output()
+	require.NoError(t, err)
+	assert.Equal(t, "Add feature 3\n", string(output))
+}
+
+func TestSquashMergeCheckIsBestEffort(t *testing.T) {
+	repoPath, cleanup := setupRebranchTestRepo(t)
+	defer cleanup()
+
+	originalDir, err := os.Getwd()
+	require.NoError(t, err)
+	defer os.Chdir(originalDir)
+	require.NoError(t, os.Chdir(repoPath))
+
+	// A git without merge-tree --write-tree (older than 2.38)
+	realGit, err := exec.LookPath("git")
+	require.NoError(t, err)
+	binDir := t.TempDir()
+	wrapper := fmt.Sprintf("#!/bin/sh\n[ \"$1\" = merge-tree ] && exit 129\nexec %q \"$@\"\n", realGit)
+	require.NoError(t, os.WriteFile(filepath.Join(binDir, "git"), []byte(wrapper), 0755))
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	output := captureStdout(t, func() {
+		err = rebranch.RunCmd([]string{"main"}, rebranch.Options{Editor: &MockEditor{}})
+	})
+	require.NoError(t, err)
+	assert.Contains(t, output, "Warning: could not check for squash-merged commits")
+
+	err = rebranch.RunCmd([]string{"--done"}, rebranch.Options{})
+	require.NoError(t, err)
+	cmd := exec.Command(realGit, "log", "--format=%s", "main..feature")
+	cmd.Dir = repoPath
+	logOutput, err := cmd.Output()
+	require.NoError(t, err)
+	assert.Equal(t, "Add feature 3\nAdd feature 2\nAdd feature 1\n", string(logOutput))
+}
+
+func TestSquashMergeCheckIsBounded(t *testing.T) {
+	repoPath, cleanup := setupRebranchTestRepo(t)
+	defer cleanup()
+
+	originalDir, err := os.Getwd()
+	require.NoError(t, err)
+	defer os.Chdir(originalDir)
+	require.NoError(t, os.Chdir(repoPath))
+
+	for i := 4; i <= rebranch.MaxSquashMergedPrefix+10; i++ {
+		require.NoError(t, createCommitInRepo(repoPath, fmt.Sprintf("feature%d.txt", i), "content", fmt.Sprintf("Add feature %d", i)))
+	}
+
+	// Count the in-memory merges
+	realGit, err := exec.LookPath("git")
+	require.NoError(t, err)
+	binDir := t.TempDir()
+	logPath := filepath.Join(binDir, "merges.log")
+	wrapper := fmt.Sprintf("#!/bin/sh\n[ \"$1\" = merge-tree ] && echo merge >> %q\nexec %q \"$@\"\n", logPath, realGit)
+	require.NoError(t, os.WriteFile(filepath.Join(binDir, "git"), []byte(wrapper), 0755))
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	err = rebranch.RunCmd([]string{"main"}, rebranch.Options{Editor: &MockEditor{}})
+	require.NoError(t, err)
+
+	data, err := os.ReadFile(logPath)
+	require.NoError(t, err)
+	assert.Equal(t, rebranch.MaxSquashMergedPrefix, strings.Count(string(data), "merge\n"))
+}
+
+func TestRewordSquashAndFixup(t *testing.T) {
+	repoPath, cleanup := setupRebranchTestRepo(t)
+	defer cleanup()
+
+	originalDir, err := os.Getwd()
+	require.NoError(t, err)
+	defer os.Chdir(originalDir)
+	require.NoError(t, os.Chdir(repoPath))
+
+	editor := &MockEditor{
+		ModifyFunc: func(filePath string) error {
+			data, err := os.ReadFile(filePath)
+			if err != nil {
+				return err
+			}
+			content := string(data)
+
+			switch {
+			case strings.HasSuffix(filePath, rebranch.PickFileName):
+				// reword 1, squash 2 into it, fixup 3 into the result
+				content = regexp.MustCompile(`(?m)^pick (\w+ Add feature 1)`).ReplaceAllString(content, "reword $1")
+				content = regexp.MustCompile(`(?m)^pick (\w+ Add feature 2)`).ReplaceAllString(content, "s $1")
+				content = regexp.MustCompile(`(?m)^pick (\w+ Add feature 3)`).ReplaceAllString(content, "f $1")
+			case strings.Contains(content, "combination of 2 commits"):
+				assert.Contains(t, content, "Reworded feature 1")
+				assert.Contains(t, content, "Add feature 2")
+				content = "Features 1 and 2\n"
+			default:
+				assert.Contains(t, content, "Add feature 1")
+				content = "Reworded feature 1\n# comment lines are stripped\n"
+			}
+
+			return os.WriteFile(filePath, []byte(content), 0644)
+		},
+	}
+
+	err = rebranch.RunCmd([]string{"main"}, rebranch.Options{Editor: editor})
+	require.NoError(t, err)
+
+	err = rebranch.RunCmd([]string{"--done"}, rebranch.Options{})
+	require.NoError(t, err)
+
+	// All three commits were melded into a single commit with the squash message
+	cmd := exec.Command("git", "log", "--format=%B", "main..feature")
+	cmd.Dir = repoPath
+	output, err := cmd.Output()
+	require.NoError(t, err)
+	assert.Equal(t, "Features 1 and 2\n\n", string(output))
+
+	for _, file := range []string{"feature1.txt", "feature2.txt", "feature3.txt"} {
+		_, err := os.Stat(filepath.Join(repoPath, file))
+		assert.NoError(t, err)
+	}
+}
+
+func TestFailedMessageStopsResumably(t *testing.T) {
+	repoPath, cleanup := setupRebranchTestRepo(t)
+	defer cleanup()
+
+	originalDir, err := os.Getwd()
+	require.NoError(t, err)
+	defer os.Chdir(originalDir)
+	require.NoError(t, os.Chdir(repoPath))
+
+	// The editor fails on the first message it is given
+	editorFails := true
+	editor := &MockEditor{
+		ModifyFunc: func(filePath string) error {
+			data, err := os.ReadFile(filePath)
+			if err != nil {
+				return err
+			}
+			content := string(data)
+
+			switch {
+			case strings.HasSuffix(filePath, rebranch.PickFileName):
+				content = regexp.MustCompile(`(?m)^pick (\w+ Add feature 2)`).ReplaceAllString(content, "reword $1")
+			case editorFails:
+				return errors.New("editor exited with status 1")
+			default:
+				content = "Reworded feature 2\n"
+			}
+
+			return os.WriteFile(filePath, []byte(content), 0644)
+		},
+	}
+
+	err = rebranch.RunCmd([]string{"main"}, rebranch.Options{Editor: editor})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to reword")
+	assert.Contains(t, err.Error(), "rebranch --continue")
+
+	// The pick landed and the rebranch stopped at it
+	store, err := rebranch.NewFileStoreInPath(repoPath)
+	require.NoError(t, err)
+	state, err := store.LoadState()
+	require.NoError(t, err)
+	assert.Equal(t, "message-failed", state.Stage)
+	assert.Equal(t, 1, state.CurrentCommitIdx)
+	output := captureStdout(t, func() {
+		require.NoError(t, rebranch.RunCmd([]string{"--status"}, rebranch.Options{}))
+	})
+	assert.Contains(t, output, "Message not written")
+
+	// A failing editor again keeps it stopped
+	err = rebranch.RunCmd([]string{"--continue"}, rebranch.Options{Editor: editor})
+	require.Error(t, err)
+	state, err = store.LoadState()
+	require.NoError(t, err)
+	assert.Equal(t, "message-failed", state.Stage)
+
+	editorFails = false
+	err = rebranch.RunCmd([]string{"--continue"}, rebranch.Options{Editor: editor})
+	require.NoError(t, err)
+	err = rebranch.RunCmd([]string{"--done"}, rebranch.Options{})
+	require.NoError(t, err)
+
+	cmd := exec.Command("git", "log", "--format=%s", "main..feature")
+	cmd.Dir = repoPath
+	logOutput, err := cmd.Output()
+	require.NoError(t, err)
+	assert.Equal(t, "Add feature 3\nReworded feature 2\nAdd feature 1\n", string(logOutput))
+}
+
+func TestSkipFailedMessage(t *testing.T) {
+	repoPath, cleanup := setupRebranchTestRepo(t)
+	defer cleanup()
+
+	originalDir, err := os.Getwd()
+	require.NoError(t, err)
+	defer os.Chdir(originalDir)
+	require.NoError(t, os.Chdir(repoPath))
+
+	editor := &MockEditor{
+		ModifyFunc: func(filePath string) error {
+			if !strings.HasSuffix(filePath, rebranch.PickFileName) {
+				return errors.New("editor exited with status 1")
+			}
+			data, err := os.ReadFile(filePath)
+			if err != nil {
+				return err
+			}
+			content := regexp.MustCompile(`(?m)^pick (\w+ Add feature 3)`).ReplaceAllString(string(data), "s $1")
+			return os.WriteFile(filePath, []byte(content), 0644)
+		},
+	}
+
+	err = rebranch.RunCmd([]string{"main"}, rebranch.Options{Editor: editor})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to squash")
+
+	// --skip drops the commit whose message failed
+	err = rebranch.RunCmd([]string{"--skip"}, rebranch.Options{Editor: editor})
+	require.NoError(t, err)
+	err = rebranch.RunCmd([]string{"--done"}, rebranch.Options{})
+	require.NoError(t, err)
+
+	cmd := exec.Command("git", "log", "--format=%s", "main..feature")
+	cmd.Dir = repoPath
+	output, err := cmd.Output()
+	require.NoError(t, err)
+	assert.Equal(t, "Add feature 2\nAdd feature 1\n", string(output))
+	assert.NoFileExists(t, filepath.Join(repoPath, "feature3.txt"))
+}
+
+func TestEmptySquashMessageAborts(t *testing.T) {
+	repoPath, cleanup := setupRebranchTestRepo(t)
+	defer cleanup()
+
+	originalDir, err := os.Getwd()
+	require.NoError(t, err)
+	defer os.Chdir(originalDir)
+	require.NoError(t, os.Chdir(repoPath))
+
+	message := "# only comments\n"
+	editor := &MockEditor{
+		ModifyFunc: func(filePath string) error {
+			data, err := os.ReadFile(filePath)
+			if err != nil {
+				return err
+			}
+			content := string(data)
+			if strings.HasSuffix(filePath, rebranch.PickFileName) {
+				content = regexp.MustCompile(`(?m)^pick (\w+ Add feature 3)`).ReplaceAllString(content, "s $1")
+			} else {
+				content = message
+			}
+			return os.WriteFile(filePath, []byte(content), 0644)
+		},
+	}
+
+	runGit := func(args ...string) string {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = repoPath
+		output, err := cmd.Output()
+		require.NoError(t, err)
+		return strings.TrimSpace(string(output))
+	}
+
+	// An emptied message is not a fixup: nothing is squashed
+	err = rebranch.RunCmd([]string{"main"}, rebranch.Options{Editor: editor})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "empty commit message")
+	store, err := rebranch.NewFileStoreInPath(repoPath)
+	require.NoError(t, err)
+	state, err := store.LoadState()
+	require.NoError(t, err)
+	assert.Equal(t, "message-failed", state.Stage)
+	assert.Equal(t, "Add feature 3\nAdd feature 2\nAdd feature 1", runGit("log", "--format=%s", "main.."+state.TempBranch))
+
+	message = "Features 2 and 3\n"
+	err = rebranch.RunCmd([]string{"--continue"}, rebranch.Options{Editor: editor})
+	require.NoError(t, err)
+	err = rebranch.RunCmd([]string{"--done"}, rebranch.Options{})
+	require.NoError(t, err)
+	assert.Equal(t, "Features 2 and 3\nAdd feature 1", runGit("log", "--format=%s", "main..feature"))
+}
+
+func TestEditStopsForAmending(t *testing.T) {
+	repoPath, cleanup := setupRebranchTestRepo(t)
+	defer cleanup()
+
+	originalDir, err := os.Getwd()
+	require.NoError(t, err)
+	defer os.Chdir(originalDir)
+	require.NoError(t, os.Chdir(repoPath))
+
+	editor := &MockEditor{
+		ModifyFunc: func(filePath string) error {
+			data, err := os.ReadFile(filePath)
+			if err != nil {
+				return err
+			}
+			content := regexp.MustCompile(`(?m)^pick (\w+ Add feature 2)`).ReplaceAllString(string(data), "e $1")
+			return os.WriteFile(filePath, []byte(content), 0644)
+		},
+	}
+
+	err = rebranch.RunCmd([]string{"main"}, rebranch.Options{Editor: editor})
+	require.NoError(t, err)
+
+	// Stopped after applying feature 2
+	store, err := rebranch.NewFileStoreInPath(repoPath)
+	require.NoError(t, err)
+	state, err := store.LoadState()
+	require.NoError(t, err)
+	assert.Equal(t, "editing", state.Stage)
+	assert.Equal(t, 1, state.CurrentCommitIdx)
+	_, err = os.Stat(filepath.Join(repoPath, "feature3.txt"))
+	assert.True(t, os.IsNotExist(err))
+
+	// --done is refused while stopped
+	err = rebranch.RunCmd([]string{"--done"}, rebranch.Options{})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "not ready to finish")
+
+	// Amend the stopped commit
+	require.NoError(t, os.WriteFile(filepath.Join(repoPath, "amended.txt"), []byte("Amended"), 0644))
+	cmd := exec.Command("git", "add", "amended.txt")
+	cmd.Dir = repoPath
+	require.NoError(t, cmd.Run())
+	cmd = exec.Command("git", "commit", "--amend", "-m", "Add feature 2 (amended)")
+	cmd.Dir = repoPath
+	require.NoError(t, cmd.Run())
+
+	err = rebranch.RunCmd([]string{"--continue"}, rebranch.Options{Editor: editor})
+	require.NoError(t, err)
+
+	err = rebranch.RunCmd([]string{"--done"}, rebranch.Options{})
+	require.NoError(t, err)
+
+	cmd = exec.Command("git", "log", "--format=%s", "main..feature")
+	cmd.Dir = repoPath
+	output, err := cmd.Output()
+	require.NoError(t, err)
+	assert.Equal(t, "Add feature 3\nAdd feature 2 (amended)\nAdd feature 1\n", string(output))
+	_, err = os.Stat(filepath.Join(repoPath, "amended.txt"))
+	assert.NoError(t, err)
+}
+
+func TestReorderCommits(t *testing.T) {
+	repoPath, cleanup := setupRebranchTestRepo(t)
+	defer cleanup()
+
+	originalDir, err := os.Getwd()
+	require.NoError(t, err)
+	defer os.Chdir(originalDir)
+	require.NoError(t, os.Chdir(repoPath))
+
+	// Reverse the order of the commit lines
+	editor := &MockEditor{
+		ModifyFunc: func(filePath string) error {
+			data, err := os.ReadFile(filePath)
+			if err != nil {
+				return err
+			}
+
+			var header, picks []string
+			for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+				if strings.HasPrefix(line, "pick") {
+					picks = append([]string{line}, picks...)
+				} else {
+					header = append(header, line)
+				}
+			}
+
+			content := strings.Join(append(header, picks...), "\n") + "\n"
+			return os.WriteFile(filePath, []byte(content), 0644)
+		},
+	}
+
+	err = rebranch.RunCmd([]string{"main"}, rebranch.Options{Editor: editor})
+	require.NoError(t, err)
+
+	err = rebranch.RunCmd([]string{"--done"}, rebranch.Options{})
+	require.NoError(t, err)
+
+	cmd := exec.Command("git", "log", "--format=%s", "main..feature")
+	cmd.Dir = repoPath
+	output, err := cmd.Output()
+	require.NoError(t, err)
+	assert.Equal(t, "Add feature 1\nAdd feature 2\nAdd feature 3\n", string(output))
+}
+
+func TestMissingCommitsInPickFile(t *testing.T) {
+	repoPath, cleanup := setupRebranchTestRepo(t)
+	defer cleanup()
+
+	originalDir, err := os.Getwd()
+	require.NoError(t, err)
+	defer os.Chdir(originalDir)
+	require.NoError(t, os.Chdir(repoPath))
+
+	// Delete the line for feature 2
+	editor := &MockEditor{
+		ModifyFunc: func(filePath string) error {
+			data, err := os.ReadFile(filePath)
+			if err != nil {
+				return err
+			}
+			content := regexp.MustCompile(`(?m)^pick \w+ Add feature 2\n`).ReplaceAllString(string(data), "")
+			return os.WriteFile(filePath, []byte(content), 0644)
+		},
+	}
+
+	// Refused by default
+	err = rebranch.RunCmd([]string{"main"}, rebranch.Options{Editor: editor})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "commits missing from the pick file")
+
+	// Treated as dropped with --drop-missing, which may follow the base branch
+	err = rebranch.RunCmd([]string{"main", "--drop-missing"}, rebranch.Options{Editor: editor})
+	require.NoError(t, err)
+
+	err = rebranch.RunCmd([]string{"--done"}, rebranch.Options{})
+	require.NoError(t, err)
+
+	cmd := exec.Command("git", "log", "--format=%s", "main..feature")
+	cmd.Dir = repoPath
+	output, err := cmd.Output()
+	require.NoError(t, err)
+	assert.Equal(t, "Add feature 3\nAdd feature 1\n", string(output))
+}
+
+func TestExecCommands(t *testing.T) {
+	repoPath, cleanup := setupRebranchTestRepo(t)
+	defer cleanup()
+
+	originalDir, err := os.Getwd()
+	require.NoError(t, err)
+	defer os.Chdir(originalDir)
+	require.NoError(t, os.Chdir(repoPath))
+
+	// Add a failing exec after feature 2 on top of the --exec lines
+	var pickFile string
+	editor := &MockEditor{
+		ModifyFunc: func(filePath string) error {
+			data, err := os.ReadFile(filePath)
+			if err != nil {
+				return err
+			}
+			pickFile = string(data)
+			content := regexp.MustCompile(`(?m)^(pick \w+ Add feature 2)$`).ReplaceAllString(pickFile, "$1\nx false")
+			return os.WriteFile(filePath, []byte(content), 0644)
+		},
+	}
+
+	logCommand := "git log -1 --format=%s >> .git/exec.log"
+	err = rebranch.RunCmd([]string{"--exec", logCommand, "main"}, rebranch.Options{Editor: editor})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "exec failed: false")
+	assert.Equal(t, 3, strings.Count(pickFile, "exec "+logCommand+"\n"))
+
+	store, err := rebranch.NewFileStoreInPath(repoPath)
+	require.NoError(t, err)
+	state, err := store.LoadState()
+	require.NoError(t, err)
+	assert.Equal(t, "exec-failed", state.Stage)
+
+	// Resume after the failed command
+	err = rebranch.RunCmd([]string{"--continue"}, rebranch.Options{Editor: editor})
+	require.NoError(t, err)
+
+	err = rebranch.RunCmd([]string{"--done"}, rebranch.Options{})
+	require.NoError(t, err)
+
+	// The --exec command ran after each applied commit
+	execLog, err := os.ReadFile(filepath.Join(repoPath, ".git", "exec.log"))
+	require.NoError(t, err)
+	assert.Equal(t, "Add feature 1\nAdd feature 2\nAdd feature 3\n", string(execLog))
+}
+
+func TestStackRebranch(t *testing.T) {
+	repoPath, cleanup := setupRebranchTestRepo(t)
+	defer cleanup()
+
+	originalDir, err := os.Getwd()
+	require.NoError(t, err)
+	defer os.Chdir(originalDir)
+	require.NoError(t, os.Chdir(repoPath))
+
+	// Stack: main <- part1 (feature 1) <- part2 (feature 2) <- feature (feature 3)
+	for branch, rev := range map[string]string{"part1": "feature~2", "part2": "feature~1"} {
+		cmd := exec.Command("git", "branch", branch, rev)
+		cmd.Dir = repoPath
+		require.NoError(t, cmd.Run())
+	}
+
+	// Move main forward
+	cmd := exec.Command("git", "checkout", "main")
+	cmd.Dir = repoPath
+	require.NoError(t, cmd.Run())
+	require.NoError(t, createCommitInRepo(repoPath, "main.txt", "Main content", "Main branch work"))
+	cmd = exec.Command("git", "checkout", "feature")
+	cmd.Dir = repoPath
+	require.NoError(t, cmd.Run())
+
+	editor := &MockEditor{}
+
+	err = rebranch.RunCmd([]string{"--stack", "main"}, rebranch.Options{Editor: editor})
+	require.NoError(t, err)
+
+	store, err := rebranch.NewFileStoreInPath(repoPath)
+	require.NoError(t, err)
+	state, err := store.LoadState()
+	require.NoError(t, err)
+	require.Len(t, state.StackBranches, 2)
+	assert.Equal(t, "part1", state.StackBranches[0].Name)
+	assert.Equal(t, "part2", state.StackBranches[1].Name)
+
+	err = rebranch.RunCmd([]string{"--done"}, rebranch.Options{})
+	require.NoError(t, err)
+
+	// Every branch in the stack now sits on top of the new main
+	for branch, parent := range map[string]string{"part1": "main", "part2": "part1", "feature": "part2"} {
+		cmd := exec.Command("git", "rev-parse", branch+"~1", parent)
+		cmd.Dir = repoPath
+		output, err := cmd.Output()
+		require.NoError(t, err)
+		shas := strings.Fields(string(output))
+		assert.Equal(t, shas[1], shas[0], "%s should be based on %s", branch, parent)
+	}
+}
+
+func TestUpdateRefLines(t *testing.T) {
+	repoPath, cleanup := setupRebranchTestRepo(t)
+	defer cleanup()
+
+	originalDir, err := os.Getwd()
+	require.NoError(t, err)
+	defer os.Chdir(originalDir)
+	require.NoError(t, os.Chdir(repoPath))
+
+	for branch, rev := range map[string]string{"part1": "feature~2", "part2": "feature~1"} {
+		cmd := exec.Command("git", "branch", branch, rev)
+		cmd.Dir = repoPath
+		require.NoError(t, cmd.Run())
+	}
+	part2Before := revParse(t, repoPath, "part2")
+
+	// Keep part2 where it is and move part1 up to feature 2
+	var pickFile string
+	editor := &MockEditor{
+		ModifyFunc: func(filePath string) error {
+			data, err := os.ReadFile(filePath)
+			if err != nil {
+				return err
+			}
+			pickFile = string(data)
+
+			content := strings.Replace(pickFile, "update-ref refs/heads/part2\n", "", 1)
+			content = strings.Replace(content, "update-ref refs/heads/part1\n", "", 1)
+			content = regexp.MustCompile(`(?m)^(pick \w+ Add feature 2)$`).ReplaceAllString(content, "$1\nupdate-ref refs/heads/part1")
+			return os.WriteFile(filePath, []byte(content), 0644)
+		},
+	}
+
+	err = rebranch.RunCmd([]string{"--update-refs", "main"}, rebranch.Options{Editor: editor})
+	require.NoError(t, err)
+
+	// Each update-ref line follows the tip commit of its branch
+	assert.Regexp(t, `(?m)^pick \w+ Add feature 1\nupdate-ref refs/heads/part1\npick \w+ Add feature 2\nupdate-ref refs/heads/part2\n`, pickFile)
+
+	err = rebranch.RunCmd([]string{"--done"}, rebranch.Options{})
+	require.NoError(t, err)
+
+	assert.Equal(t, revParse(t, repoPath, "feature~1"), revParse(t, repoPath, "part1"))
+	assert.Equal(t, part2Before, revParse(t, repoPath, "part2"))
+}
+
+func TestRevisionBases(t *testing.T) {
+	repoPath, cleanup := setupRebranchTestRepo(t)
+	defer cleanup()
+
+	originalDir, err := os.Getwd()
+	require.NoError(t, err)
+	defer os.Chdir(originalDir)
+	require.NoError(t, os.Chdir(repoPath))
+
+	// Move main forward and publish it as a remote-tracking branch and a tag
+	cmd := exec.Command("git", "checkout", "main")
+	cmd.Dir = repoPath
+	require.NoError(t, cmd.Run())
+	require.NoError(t, createCommitInRepo(repoPath, "main.txt", "Main content", "Main branch work"))
+	for _, args := range [][]string{
+		{"update-ref", "refs/remotes/origin/main", "main"},
+		{"tag", "-a", "-m", "Release", "v1.0", "main"},
+		{"checkout", "feature"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = repoPath
+		require.NoError(t, cmd.Run())
+	}
+	mainSHA := revParse(t, repoPath, "main")
+
+	store, err := rebranch.NewFileStoreInPath(repoPath)
+	require.NoError(t, err)
+
+	for _, base := range []string{"origin/main", "v1.0", mainSHA[:10], "feature~3"} {
+		t.Run(base, func(t *testing.T) {
+			err := rebranch.RunCmd([]string{base}, rebranch.Options{Editor: &MockEditor{}})
+			require.NoError(t, err)
+
+			state, err := store.LoadState()
+			require.NoError(t, err)
+			assert.Equal(t, base, state.BaseBranch)
+			assert.Equal(t, revParse(t, repoPath, base+"^{commit}"), state.BaseSHA)
+			assert.Equal(t, state.BaseSHA, revParse(t, repoPath, state.TempBranch+"~3"))
+
+			err = rebranch.RunCmd([]string{"--abort"}, rebranch.Options{})
+			require.NoError(t, err)
+		})
+	}
+
+	// The recorded base does not follow the remote-tracking branch after a fetch
+	err = rebranch.RunCmd([]string{"origin/main"}, rebranch.Options{Editor: &MockEditor{}})
+	require.NoError(t, err)
+	cmd = exec.Command("git", "update-ref", "refs/remotes/origin/main", "main~1")
+	cmd.Dir = repoPath
+	require.NoError(t, cmd.Run())
+
+	state, err := store.LoadState()
+	require.NoError(t, err)
+	assert.Equal(t, mainSHA, state.BaseSHA)
+}
+
+func TestOntoUpstream(t *testing.T) {
+	repoPath, cleanup := setupRebranchTestRepo(t)
+	defer cleanup()
+
+	originalDir, err := os.Getwd()
+	require.NoError(t, err)
+	defer os.Chdir(originalDir)
+	require.NoError(t, os.Chdir(repoPath))
+
+	// feature was stacked on old-parent, which main has since replaced with its own work
+	cmd := exec.Command("git", "branch", "old-parent", "feature~2")
+	cmd.Dir = repoPath
+	require.NoError(t, cmd.Run())
+	cmd = exec.Command("git", "checkout", "main")
+	cmd.Dir = repoPath
+	require.NoError(t, cmd.Run())
+	require.NoError(t, createCommitInRepo(repoPath, "main.txt", "Main content", "Main branch work"))
+	cmd = exec.Command("git", "checkout", "feature")
+	cmd.Dir = repoPath
+	require.NoError(t, cmd.Run())
+
+	err = rebranch.RunCmd([]string{"--onto", "main", "old-parent"}, rebranch.Options{Editor: &MockEditor{}})
+	require.NoError(t, err)
+
+	store, err := rebranch.NewFileStoreInPath(repoPath)
+	require.NoError(t, err)
+	state, err := store.LoadState()
+	require.NoError(t, err)
+	assert.Equal(t, "main", state.BaseBranch)
+	assert.Equal(t, "old-parent", state.Upstream)
+	assert.Equal(t, revParse(t, repoPath, "old-parent"), state.UpstreamSHA)
+	assert.Len(t, state.CommitsToApply, 2)
+
+	err = rebranch.RunCmd([]string{"--done"}, rebranch.Options{})
+	require.NoError(t, err)
+
+	// Only the commits after old-parent were moved onto main
+	assert.Equal(t, revParse(t, repoPath, "main"), revParse(t, repoPath, "feature~2"))
+	_, err = os.Stat(filepath.Join(repoPath, "feature1.txt"))
+	assert.True(t, os.IsNotExist(err))
+	for _, file := range []string{"main.txt", "feature2.txt", "feature3.txt"} {
+		_, err := os.Stat(filepath.Join(repoPath, file))
+		assert.NoError(t, err)
+	}
+
+	// An unknown upstream is rejected before anything changes
+	err = rebranch.RunCmd([]string{"--onto", "main", "nonexistent"}, rebranch.Options{Editor: &MockEditor{}})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "upstream 'nonexistent' does not exist")
+}
+
+func TestInferredBase(t *testing.T) {
+	repoPath, cleanup := setupRebranchTestRepo(t)
+	defer cleanup()
+
+	originalDir, err := os.Getwd()
+	require.NoError(t, err)
+	defer os.Chdir(originalDir)
+	require.NoError(t, os.Chdir(repoPath))
+
+	// Flags alone still start a rebranch onto the inferred base
+	err = rebranch.RunCmd([]string{"--drop-missing"}, rebranch.Options{Editor: &MockEditor{}})
+	require.NoError(t, err)
+
+	store, err := rebranch.NewFileStoreInPath(repoPath)
+	require.NoError(t, err)
+	state, err := store.LoadState()
+	require.NoError(t, err)
+	assert.Equal(t, "main", state.BaseBranch)
+	assert.Len(t, state.CommitsToApply, 3)
+
+	err = rebranch.RunCmd([]string{"--abort"}, rebranch.Options{})
+	require.NoError(t, err)
+
+	// No arguments at all behaves the same
+	err = rebranch.RunCmd(nil, rebranch.Options{Editor: &MockEditor{}})
+	require.NoError(t, err)
+	state, err = store.LoadState()
+	require.NoError(t, err)
+	assert.Equal(t, "main", state.BaseBranch)
+}
+
+// setupMergedTopic merges a topic branch into feature and moves main forward
+func setupMergedTopic(t *testing.T, repoPath string) {
+	runGit := func(args ...string) {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = repoPath
+		require.NoError(t, cmd.Run())
+	}
+
+	runGit("checkout", "-b", "topic", "main")
+	require.NoError(t, createCommitInRepo(repoPath, "topic.txt", "Topic content", "Topic work"))
+	runGit("checkout", "feature")
+	runGit("merge", "--no-ff", "-m", "Merge branch 'topic' into feature", "topic")
+	require.NoError(t, createCommitInRepo(repoPath, "feature4.txt", "Feature 4 content", "Add feature 4"))
+	runGit("checkout", "main")
+	require.NoError(t, createCommitInRepo(repoPath, "main.txt", "Main content", "Main branch work"))
+	runGit("checkout", "feature")
+}
+
+func TestMergeCommitModes(t *testing.T) {
+	tests := []struct {
+		mode       string
+		hasTopic   bool
+		mergeCount string
+	}{
+		{"", true, "0"}, // linearize is the default
+		{"skip", false, "0"},
+		{"linearize", true, "0"},
+		{"rebase-merges", true, "1"},
+	}
+
+	for _, tt := range tests {
+		t.Run("mode="+tt.mode, func(t *testing.T) {
+			repoPath, cleanup := setupRebranchTestRepo(t)
+			defer cleanup()
+
+			originalDir, err := os.Getwd()
+			require.NoError(t, err)
+			defer os.Chdir(originalDir)
+			require.NoError(t, os.Chdir(repoPath))
+
+			setupMergedTopic(t, repoPath)
+
+			var pickFile string
+			editor := &MockEditor{
+				ModifyFunc: func(filePath string) error {
+					data, err := os.ReadFile(filePath)
+					pickFile = string(data)
+					return err
+				},
+			}
+
+			args := []string{"main"}
+			if tt.mode != "" {
+				args = append([]string{"--merges=" + tt.mode}, args...)
+			}
+			err = rebranch.RunCmd(args, rebranch.Options{Editor: editor})
+			require.NoError(t, err)
+			switch tt.mode {
+			case "rebase-merges":
+				assert.Regexp(t, `(?m)^merge -C [0-9a-f]{7} [0-9a-f]{7} # Merge branch 'topic' into feature$`, pickFile)
+				assert.Regexp(t, `(?m)^reset onto$`, pickFile)
+			case "skip":
+				// The merged-in commit is left out, but visibly
+				assert.Regexp(t, `(?m)^drop [0-9a-f]{7} Topic work # brought in by a merge$`, pickFile)
+				fallthrough
+			default:
+				assert.Regexp(t, `(?m)^drop [0-9a-f]{7} Merge branch 'topic' into feature # merge commit$`, pickFile)
+			}
+
+			err = rebranch.RunCmd([]string{"--done"}, rebranch.Options{})
+			require.NoError(t, err)
+
+			// The rebranched history sits on the new main
+			cmd := exec.Command("git", "merge-base", "--is-ancestor", "main", "feature")
+			cmd.Dir = repoPath
+			assert.NoError(t, cmd.Run())
+
+			_, err = os.Stat(filepath.Join(repoPath, "topic.txt"))
+			assert.Equal(t, tt.hasTopic, err == nil)
+			_, err = os.Stat(filepath.Join(repoPath, "feature4.txt"))
+			assert.NoError(t, err)
+
+			cmd = exec.Command("git", "rev-list", "--count", "--merges", "main..feature")
+			cmd.Dir = repoPath
+			output, err := cmd.Output()
+			require.NoError(t, err)
+			assert.Equal(t, tt.mergeCount, strings.TrimSpace(string(output)))
+		})
+	}
+}
+
+func TestPickMergeCommitRejected(t *testing.T) {
+	repoPath, cleanup := setupRebranchTestRepo(t)
+	defer cleanup()
+
+	originalDir, err := os.Getwd()
+	require.NoError(t, err)
+	defer os.Chdir(originalDir)
+	require.NoError(t, os.Chdir(repoPath))
+
+	setupMergedTopic(t, repoPath)
+
+	editor := &MockEditor{
+		ModifyFunc: func(filePath string) error {
+			data, err := os.ReadFile(filePath)
+			if err != nil {
+				return err
+			}
+			content := regexp.MustCompile(`(?m)^drop (\w+ Merge)`).ReplaceAllString(string(data), "pick $1")
+			return os.WriteFile(filePath, []byte(content), 0644)
+		},
+	}
+
+	err = rebranch.RunCmd([]string{"main"}, rebranch.Options{Editor: editor})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "cannot pick merge commit")
+}
+
+func TestUndefinedMergeLabelRejected(t *testing.T) {
+	repoPath, cleanup := setupRebranchTestRepo(t)
+	defer cleanup()
+
+	originalDir, err := os.Getwd()
+	require.NoError(t, err)
+	defer os.Chdir(originalDir)
+	require.NoError(t, os.Chdir(repoPath))
+
+	setupMergedTopic(t, repoPath)
+
+	removeLines := func(pattern string) *MockEditor {
+		return &MockEditor{
+			ModifyFunc: func(filePath string) error {
+				data, err := os.ReadFile(filePath)
+				if err != nil {
+					return err
+				}
+				content := regexp.MustCompile(pattern).ReplaceAllString(string(data), "")
+				return os.WriteFile(filePath, []byte(content), 0644)
+			},
+		}
+	}
+
+	// The merged-in topic commit has no label, so the merge would use the old one
+	err = rebranch.RunCmd([]string{"--merges=rebase-merges", "main"}, rebranch.Options{Editor: removeLines(`(?m)^label [0-9a-f]{7}\n`)})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "undefined label")
+
+	// onto is known without a label line
+	err = rebranch.RunCmd([]string{"--merges=rebase-merges", "main"}, rebranch.Options{Editor: removeLines(`(?m)^label onto\n`)})
+	require.NoError(t, err)
+	err = rebranch.RunCmd([]string{"--done"}, rebranch.Options{})
+	require.NoError(t, err)
+
+	cmd := exec.Command("git", "rev-list", "--count", "--merges", "main..feature")
+	cmd.Dir = repoPath
+	output, err := cmd.Output()
+	require.NoError(t, err)
+	assert.Equal(t, "1", strings.TrimSpace(string(output)))
+}
+
+func TestSkipConflictingCommit(t *testing.T) {
+	repoPath, cleanup := setupRebranchTestRepo(t)
+	defer cleanup()
+
+	originalDir, err := os.Getwd()
+	require.NoError(t, err)
+	defer os.Chdir(originalDir)
+	require.NoError(t, os.Chdir(repoPath))
+
+	// main adds feature1.txt with different content, so the first pick conflicts
+	cmd := exec.Command("git", "checkout", "main")
+	cmd.Dir = repoPath
+	require.NoError(t, cmd.Run())
+	require.NoError(t, createCommitInRepo(repoPath, "feature1.txt", "Upstream content", "Upstream feature 1"))
+	cmd = exec.Command("git", "checkout", "feature")
+	cmd.Dir = repoPath
+	require.NoError(t, cmd.Run())
+
+	// --skip is only valid while stopped for conflicts
+	err = rebranch.RunCmd([]string{"--skip"}, rebranch.Options{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "no rebranch operation in progress")
+
+	err = rebranch.RunCmd([]string{"main"}, rebranch.Options{Editor: &MockEditor{}})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "rebranch --skip")
+
+	err = rebranch.RunCmd([]string{"--skip"}, rebranch.Options{})
+	require.NoError(t, err)
+
+	store, err := rebranch.NewFileStoreInPath(repoPath)
+	require.NoError(t, err)
+	state, err := store.LoadState()
+	require.NoError(t, err)
+	assert.Equal(t, "done", state.Stage)
+	assert.Equal(t, "drop", state.CommitsToApply[0].Action)
+
+	err = rebranch.RunCmd([]string{"--done"}, rebranch.Options{})
+	require.NoError(t, err)
+
+	cmd = exec.Command("git", "log", "--format=%s", "main..feature")
+	cmd.Dir = repoPath
+	output, err := cmd.Output()
+	require.NoError(t, err)
+	assert.Equal(t, "Add feature 3\nAdd feature 2\n", string(output))
+
+	content, err := os.ReadFile(filepath.Join(repoPath, "feature1.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "Upstream content", string(content))
+}
+
+func TestSkipDiscardsCommittedResolution(t *testing.T) {
+	repoPath, cleanup := setupRebranchTestRepo(t)
+	defer cleanup()
+
+	originalDir, err := os.Getwd()
+	require.NoError(t, err)
+	defer os.Chdir(originalDir)
+	require.NoError(t, os.Chdir(repoPath))
+
+	runGit := func(args ...string) string {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = repoPath
+		output, err := cmd.Output()
+		require.NoError(t, err)
+		return strings.TrimSpace(string(output))
+	}
+
+	require.NoError(t, createCommitInRepo(repoPath, "shared.txt", "feature\n", "Shared change"))
+	runGit("checkout", "main")
+	require.NoError(t, createCommitInRepo(repoPath, "shared.txt", "main\n", "Main shared change"))
+	runGit("checkout", "feature")
+
+	err = rebranch.RunCmd([]string{"main"}, rebranch.Options{Editor: &MockEditor{}})
+	require.Error(t, err)
+	stoppedAt := runGit("rev-parse", "HEAD")
+
+	// The user commits a resolution, then decides to drop the commit after all
+	require.NoError(t, os.WriteFile(filepath.Join(repoPath, "shared.txt"), []byte("my resolution\n"), 0644))
+	runGit("add", "shared.txt")
+	runGit("commit", "-m", "My resolution")
+
+	err = rebranch.RunCmd([]string{"--skip"}, rebranch.Options{Editor: &MockEditor{}})
+	require.NoError(t, err)
+	store, err := rebranch.NewFileStoreInPath(repoPath)
+	require.NoError(t, err)
+	state, err := store.LoadState()
+	require.NoError(t, err)
+	assert.Equal(t, "done", state.Stage)
+	assert.Equal(t, stoppedAt, runGit("rev-parse", state.TempBranch))
+	assert.Equal(t, "main", runGit("show", state.TempBranch+":shared.txt"))
+}
+
+func TestContinueCommitsResolvedCherryPick(t *testing.T) {
+	repoPath, cleanup := setupRebranchTestRepo(t)
+	defer cleanup()
+
+	originalDir, err := os.Getwd()
+	require.NoError(t, err)
+	defer os.Chdir(originalDir)
+	require.NoError(t, os.Chdir(repoPath))
+
+	runGit := func(env []string, args ...string) {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = repoPath
+		cmd.Env = append(os.Environ(), env...)
+		require.NoError(t, cmd.Run())
+	}
+
+	// A commit by someone else that conflicts with main
+	require.NoError(t, os.WriteFile(filepath.Join(repoPath, "shared.txt"), []byte("feature\n"), 0644))
+	runGit(nil, "add", "shared.txt")
+	runGit([]string{"GIT_AUTHOR_NAME=Other Author", "GIT_AUTHOR_EMAIL=other@example.com"},
+		"commit", "-m", "Shared change\n\nWith a body")
+	runGit(nil, "checkout", "main")
+	require.NoError(t, createCommitInRepo(repoPath, "shared.txt", "main\n", "Main shared change"))
+	runGit(nil, "checkout", "feature")
+
+	err = rebranch.RunCmd([]string{"main"}, rebranch.Options{Editor: &MockEditor{}})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "conflict")
+
+	// Continuing before staging the resolution names the conflicted file
+	require.NoError(t, os.WriteFile(filepath.Join(repoPath, "shared.txt"), []byte("resolved\n"), 0644))
+	err = rebranch.RunCmd([]string{"--continue"}, rebranch.Options{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "shared.txt")
+
+	runGit(nil, "add", "shared.txt")
+	err = rebranch.RunCmd([]string{"--continue"}, rebranch.Options{})
+	require.NoError(t, err)
+
+	// The resolution was committed with the original author and message
+	cmd := exec.Command("git", "log", "-1", "--format=%an <%ae>%n%B", "HEAD")
+	cmd.Dir = repoPath
+	output, err := cmd.Output()
+	require.NoError(t, err)
+	assert.Equal(t, "Other Author <other@example.com>\nShared change\n\nWith a body", strings.TrimSpace(string(output)))
+
+	store, err := rebranch.NewFileStoreInPath(repoPath)
+	require.NoError(t, err)
+	state, err := store.LoadState()
+	require.NoError(t, err)
+	assert.Equal(t, "done", state.Stage)
+}
+
+func TestContinueRefusesPartialResolution(t *testing.T) {
+	repoPath, cleanup := setupRebranchTestRepo(t)
+	defer cleanup()
+
+	originalDir, err := os.Getwd()
+	require.NoError(t, err)
+	defer os.Chdir(originalDir)
+	require.NoError(t, os.Chdir(repoPath))
+
+	runGit := func(args ...string) string {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = repoPath
+		output, err := cmd.Output()
+		require.NoError(t, err)
+		return strings.TrimSpace(string(output))
+	}
+
+	require.NoError(t, createCommitInRepo(repoPath, "shared.txt", "feature\n", "Shared change"))
+	runGit("checkout", "main")
+	require.NoError(t, createCommitInRepo(repoPath, "shared.txt", "main\n", "Main shared change"))
+	runGit("checkout", "feature")
+
+	err = rebranch.RunCmd([]string{"main"}, rebranch.Options{Editor: &MockEditor{}})
+	require.Error(t, err)
+	stoppedAt := runGit("rev-parse", "HEAD")
+
+	// Half the resolution is staged, the other half is not
+	require.NoError(t, os.WriteFile(filepath.Join(repoPath, "shared.txt"), []byte("resolved\n"), 0644))
+	runGit("add", "shared.txt")
+	require.NoError(t, os.WriteFile(filepath.Join(repoPath, "shared.txt"), []byte("resolved better\n"), 0644))
+
+	err = rebranch.RunCmd([]string{"--continue"}, rebranch.Options{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "changes are not staged in")
+	assert.Contains(t, err.Error(), "shared.txt")
+	assert.Equal(t, stoppedAt, runGit("rev-parse", "HEAD"))
+	store, err := rebranch.NewFileStoreInPath(repoPath)
+	require.NoError(t, err)
+	state, err := store.LoadState()
+	require.NoError(t, err)
+	assert.Equal(t, "conflicts", state.Stage)
+
+	runGit("add", "shared.txt")
+	err = rebranch.RunCmd([]string{"--continue"}, rebranch.Options{})
+	require.NoError(t, err)
+	assert.Equal(t, "resolved better", runGit("show", "HEAD:shared.txt"))
+}
+
+func TestContinueRefusesAbandonedCherryPick(t *testing.T) {
+	repoPath, cleanup := setupRebranchTestRepo(t)
+	defer cleanup()
+
+	originalDir, err := os.Getwd()
+	require.NoError(t, err)
+	defer os.Chdir(originalDir)
+	require.NoError(t, os.Chdir(repoPath))
+
+	runGit := func(args ...string) string {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = repoPath
+		output, err := cmd.Output()
+		require.NoError(t, err)
+		return strings.TrimSpace(string(output))
+	}
+
+	require.NoError(t, createCommitInRepo(repoPath, "shared.txt", "feature\n", "Shared change"))
+	runGit("checkout", "main")
+	require.NoError(t, createCommitInRepo(repoPath, "shared.txt", "main\n", "Main shared change"))
+	runGit("checkout", "feature")
+
+	err = rebranch.RunCmd([]string{"main"}, rebranch.Options{Editor: &MockEditor{}})
+	require.Error(t, err)
+
+	// Abandoning the cherry-pick does not silently drop the commit
+	runGit("cherry-pick", "--abort")
+	err = rebranch.RunCmd([]string{"--continue"}, rebranch.Options{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "was not committed")
+	store, err := rebranch.NewFileStoreInPath(repoPath)
+	require.NoError(t, err)
+	state, err := store.LoadState()
+	require.NoError(t, err)
+	assert.Equal(t, "conflicts", state.Stage)
+
+	// Committing the resolution by hand is accepted
+	cmd := exec.Command("git", "cherry-pick", "feature")
+	cmd.Dir = repoPath
+	assert.Error(t, cmd.Run())
+	require.NoError(t, os.WriteFile(filepath.Join(repoPath, "shared.txt"), []byte("resolved\n"), 0644))
+	runGit("add", "shared.txt")
+	runGit("-c", "core.editor=true", "cherry-pick", "--continue")
+	err = rebranch.RunCmd([]string{"--continue"}, rebranch.Options{})
+	require.NoError(t, err)
+	assert.Equal(t, "Shared change", runGit("log", "-1", "--format=%s", "HEAD"))
+}
+
+// captureStdout returns what fn prints to standard output
+func captureStdout(t *testing.T, fn func()) string {
+	reader, writer, err := os.Pipe()
+	require.NoError(t, err)
+
+	stdout := os.Stdout
+	os.Stdout = writer
+	defer func() { os.Stdout = stdout }()
+
+	output := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(reader)
+		output <- string(data)
+	}()
+
+	fn()
+	writer.Close()
+	return <-output
+}
+
+func TestStatus(t *testing.T) {
+	repoPath, cleanup := setupRebranchTestRepo(t)
+	defer cleanup()
+
+	originalDir, err := os.Getwd()
+	require.NoError(t, err)
+	defer os.Chdir(originalDir)
+	require.NoError(t, os.Chdir(repoPath))
+
+	output := captureStdout(t, func() {
+		require.NoError(t, rebranch.RunCmd([]string{"--status"}, rebranch.Options{}))
+	})
+	assert.Contains(t, output, "No rebranch operation in progress")
+
+	// Make the second commit conflict with main
+	cmd := exec.Command("git", "checkout", "main")
+	cmd.Dir = repoPath
+	require.NoError(t, cmd.Run())
+	require.NoError(t, createCommitInRepo(repoPath, "feature2.txt", "Upstream content", "Upstream feature 2"))
+	cmd = exec.Command("git", "checkout", "feature")
+	cmd.Dir = repoPath
+	require.NoError(t, cmd.Run())
+
+	err = rebranch.RunCmd([]string{"main"}, rebranch.Options{Editor: &MockEditor{}})
+	require.Error(t, err)
+
+	output = captureStdout(t, func() {
+		require.NoError(t, rebranch.RunCmd([]string{"--status"}, rebranch.Options{}))
+	})
+	assert.Contains(t, output, "Rebranching feature onto main")
+	assert.Contains(t, output, "Stage: conflicts")
+	assert.Regexp(t, `Done \(1\):\n  pick [0-9a-f]{7} Add feature 1\n`, output)
+	assert.Regexp(t, `Conflicted:\n  pick [0-9a-f]{7} Add feature 2\n    conflict in feature2.txt\n`, output)
+	assert.Regexp(t, `Remaining \(1\):\n  pick [0-9a-f]{7} Add feature 3\n`, output)
+	assert.Contains(t, output, "rebranch --skip")
+}
+
+func TestDryRun(t *testing.T) {
+	repoPath, cleanup := setupRebranchTestRepo(t)
+	defer cleanup()
+
+	originalDir, err := os.Getwd()
+	require.NoError(t, err)
+	defer os.Chdir(originalDir)
+	require.NoError(t, os.Chdir(repoPath))
+
+	// main gets a conflicting feature2.txt and an identical feature3.txt
+	cmd := exec.Command("git", "checkout", "main")
+	cmd.Dir = repoPath
+	require.NoError(t, cmd.Run())
+	require.NoError(t, createCommitInRepo(repoPath, "feature2.txt", "Upstream content", "Upstream feature 2"))
+	require.NoError(t, createCommitInRepo(repoPath, "feature3.txt", "Feature 3 content", "Upstream feature 3"))
+	cmd = exec.Command("git", "checkout", "feature")
+	cmd.Dir = repoPath
+	require.NoError(t, cmd.Run())
+	headBefore := revParse(t, repoPath, "HEAD")
+
+	// Uncommitted changes do not block a dry run
+	require.NoError(t, os.WriteFile(filepath.Join(repoPath, "initial.txt"), []byte("Local edit"), 0644))
+
+	editor := &MockEditor{
+		ModifyFunc: func(filePath string) error {
+			t.Error("dry run must not open the editor")
+			return nil
+		},
+	}
+
+	output := captureStdout(t, func() {
+		require.NoError(t, rebranch.RunCmd([]string{"--dry-run", "main"}, rebranch.Options{Editor: editor}))
+	})
+	assert.Regexp(t, `[0-9a-f]{7} Add feature 1: applies cleanly`, output)
+	assert.Regexp(t, `[0-9a-f]{7} Add feature 2: conflicts in feature2.txt`, output)
+	assert.Regexp(t, `[0-9a-f]{7} Add feature 3: (becomes empty|dropped)`, output)
+
+	// Nothing was changed
+	store, err := rebranch.NewFileStoreInPath(repoPath)
+	require.NoError(t, err)
+	assert.False(t, store.StateExists())
+	assert.Equal(t, headBefore, revParse(t, repoPath, "HEAD"))
+	git, err := rebranch.NewGitInPath(repoPath)
+	require.NoError(t, err)
+	currentBranch, err := git.GetCurrentBranch()
+	require.NoError(t, err)
+	assert.Equal(t, "feature", currentBranch)
+	content, err := os.ReadFile(filepath.Join(repoPath, "initial.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "Local edit", string(content))
+	tips, err := git.GetBranchTips()
+	require.NoError(t, err)
+	for name := range tips {
+		assert.False(t, strings.HasPrefix(name, rebranch.TempBranchPrefix))
+	}
+}
+
+func TestRebranchUnrelatedHistory(t *testing.T) {
+	repoPath, cleanup := setupRebranchTestRepo(t)
+	defer cleanup()
+
+	originalDir, err := os.Getwd()
+	require.NoError(t, err)
+	defer os.Chdir(originalDir)
+	require.NoError(t, os.Chdir(repoPath))
+
+	runGit := func(args ...string) string {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = repoPath
+		output, err := cmd.Output()
+		require.NoError(t, err)
+		return strings.TrimSpace(string(output))
+	}
+
+	// An orphan branch starts with a root commit unrelated to main
+	runGit("checkout", "--orphan", "imported")
+	runGit("rm", "-rf", "--quiet", ".")
+	require.NoError(t, createCommitInRepo(repoPath, "imported1.txt", "Imported 1", "Import 1"))
+	require.NoError(t, createCommitInRepo(repoPath, "imported2.txt", "Imported 2", "Import 2"))
+
+	output := captureStdout(t, func() {
+		require.NoError(t, rebranch.RunCmd([]string{"--dry-run", "main"}, rebranch.Options{Editor: &MockEditor{}}))
+	})
+	assert.Regexp(t, `[0-9a-f]{7} Import 1: applies cleanly`, output)
+	assert.Regexp(t, `[0-9a-f]{7} Import 2: applies cleanly`, output)
+
+	err = rebranch.RunCmd([]string{"main"}, rebranch.Options{Editor: &MockEditor{}})
+	require.NoError(t, err)
+	err = rebranch.RunCmd([]string{"--done"}, rebranch.Options{})
+	require.NoError(t, err)
+
+	assert.Equal(t, "Import 2\nImport 1", runGit("log", "--format=%s", "main..imported"))
+	assert.FileExists(t, filepath.Join(repoPath, "initial.txt"))
+	assert.FileExists(t, filepath.Join(repoPath, "imported1.txt"))
+}
+
+func TestWorktreeRebranch(t *testing.T) {
+	repoPath, cleanup := setupRebranchTestRepo(t)
+	defer cleanup()
+
+	originalDir, err := os.Getwd()
+	require.NoError(t, err)
+	defer os.Chdir(originalDir)
+	require.NoError(t, os.Chdir(repoPath))
+
+	runGit := func(args ...string) string {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = repoPath
+		output, err := cmd.Output()
+		require.NoError(t, err)
+		return strings.TrimSpace(string(output))
+	}
+
+	runGit("checkout", "main")
+	require.NoError(t, createCommitInRepo(repoPath, "main.txt", "Main content", "Main change"))
+	runGit("checkout", "feature")
+
+	err = rebranch.RunCmd([]string{"--worktree", "main"}, rebranch.Options{Editor: &MockEditor{}})
+	require.NoError(t, err)
+
+	// The commits were applied in the worktree; the checkout never moved
+	store, err := rebranch.NewFileStoreInPath(repoPath)
+	require.NoError(t, err)
+	state, err := store.LoadState()
+	require.NoError(t, err)
+	assert.Equal(t, "done", state.Stage)
+	assert.Equal(t, filepath.Join(repoPath, ".git", "rebranch", state.TempBranch), state.Worktree)
+	assert.DirExists(t, state.Worktree)
+	assert.Equal(t, "feature", runGit("rev-parse", "--abbrev-ref", "HEAD"))
+	assert.NoFileExists(t, filepath.Join(repoPath, "main.txt"))
+	assert.Equal(t, "Add feature 3\nAdd feature 2\nAdd feature 1", runGit("log", "--format=%s", "main.."+state.TempBranch))
+
+	err = rebranch.RunCmd([]string{"--done"}, rebranch.Options{})
+	require.NoError(t, err)
+
+	assert.NoDirExists(t, state.Worktree)
+	assert.Equal(t, 1, strings.Count(runGit("worktree", "list", "--porcelain"), "worktree "))
+	assert.Equal(t, "feature", runGit("rev-parse", "--abbrev-ref", "HEAD"))
+	assert.Equal(t, "Add feature 3\nAdd feature 2\nAdd feature 1", runGit("log", "--format=%s", "main..feature"))
+	assert.FileExists(t, filepath.Join(repoPath, "main.txt"))
+}
+
+func TestWorktreeConflict(t *testing.T) {
+	repoPath, cleanup := setupRebranchTestRepo(t)
+	defer cleanup()
+
+	originalDir, err := os.Getwd()
+	require.NoError(t, err)
+	defer os.Chdir(originalDir)
+	require.NoError(t, os.Chdir(repoPath))
+
+	runGit := func(dir string, args ...string) string {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		output, err := cmd.Output()
+		require.NoError(t, err)
+		return strings.TrimSpace(string(output))
+	}
+
+	// main adds feature1.txt with different content, so the first pick conflicts
+	runGit(repoPath, "checkout", "main")
+	require.NoError(t, createCommitInRepo(repoPath, "feature1.txt", "Upstream content", "Upstream feature 1"))
+	runGit(repoPath, "checkout", "feature")
+	featureSHA := runGit(repoPath, "rev-parse", "feature")
+
+	startErr := rebranch.RunCmd([]string{"main", "--worktree"}, rebranch.Options{Editor: &MockEditor{}})
+	require.Error(t, startErr)
+
+	store, err := rebranch.NewFileStoreInPath(repoPath)
+	require.NoError(t, err)
+	state, err := store.LoadState()
+	require.NoError(t, err)
+	assert.Equal(t, "conflicts", state.Stage)
+	assert.Contains(t, startErr.Error(), "cd "+state.Worktree)
+
+	// The conflict is in the worktree, not in the checkout
+	content, err := os.ReadFile(filepath.Join(repoPath, "feature1.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "Feature 1 content", string(content))
+	assert.Contains(t, runGit(state.Worktree, "status", "--porcelain"), "feature1.txt")
+
+	output := captureStdout(t, func() {
+		require.NoError(t, rebranch.RunCmd([]string{"--status"}, rebranch.Options{}))
+	})
+	assert.Contains(t, output, "Worktree: "+state.Worktree)
+	assert.Contains(t, output, "conflict in feature1.txt")
+
+	// Resolve in the worktree and continue from the checkout
+	require.NoError(t, os.WriteFile(filepath.Join(state.Worktree, "feature1.txt"), []byte("Resolved"), 0644))
+	runGit(state.Worktree, "add", "feature1.txt")
+	err = rebranch.RunCmd([]string{"--continue"}, rebranch.Options{})
+	require.NoError(t, err)
+
+	state, err = store.LoadState()
+	require.NoError(t, err)
+	assert.Equal(t, "done", state.Stage)
+	assert.Equal(t, "Add feature 3\nAdd feature 2\nAdd feature 1", runGit(repoPath, "log", "--format=%s", "main.."+state.TempBranch))
+
+	// Aborting removes the worktree and leaves the source branch alone
+	err = rebranch.RunCmd([]string{"--abort"}, rebranch.Options{})
+	require.NoError(t, err)
+
+	assert.NoDirExists(t, state.Worktree)
+	assert.Equal(t, 1, strings.Count(runGit(repoPath, "worktree", "list", "--porcelain"), "worktree "))
+	assert.Equal(t, "feature", runGit(repoPath, "rev-parse", "--abbrev-ref", "HEAD"))
+	assert.Equal(t, featureSHA, runGit(repoPath, "rev-parse", "feature"))
+	assert.Empty(t, runGit(repoPath, "branch", "--list", state.TempBranch))
+}
+
+func TestUndoRestoresBackup(t *testing.T) {
+	repoPath, cleanup := setupRebranchTestRepo(t)
+	defer cleanup()
+
+	originalDir, err := os.Getwd()
+	require.NoError(t, err)
+	defer os.Chdir(originalDir)
+	require.NoError(t, os.Chdir(repoPath))
+
+	runGit := func(args ...string) string {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = repoPath
+		output, err := cmd.Output()
+		require.NoError(t, err)
+		return strings.TrimSpace(string(output))
+	}
+
+	runGit("checkout", "main")
+	require.NoError(t, createCommitInRepo(repoPath, "main.txt", "Main content", "Main change"))
+	runGit("checkout", "feature")
+	originalSHA := revParse(t, repoPath, "feature")
+
+	err = rebranch.RunCmd([]string{"--undo"}, rebranch.Options{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "no backups of feature")
+
+	// Drop a commit by mistake
+	editor := &MockEditor{
+		ModifyFunc: func(filePath string) error {
+			content, err := os.ReadFile(filePath)
+			if err != nil {
+				return err
+			}
+			updated := regexp.MustCompile(`(?m)^pick (\w+ Add feature 2)$`).ReplaceAllString(string(content), "drop $1")
+			return os.WriteFile(filePath, []byte(updated), 0644)
+		},
+	}
+	require.NoError(t, rebranch.RunCmd([]string{"main"}, rebranch.Options{Editor: editor}))
+	require.NoError(t, rebranch.RunCmd([]string{"--done"}, rebranch.Options{}))
+	rebranchedSHA := revParse(t, repoPath, "feature")
+	assert.NotEqual(t, originalSHA, rebranchedSHA)
+
+	output := captureStdout(t, func() {
+		require.NoError(t, rebranch.RunCmd([]string{"--list-backups"}, rebranch.Options{}))
+	})
+	assert.Regexp(t, `^feature  \d{4}-\d\d-\d\d \d\d:\d\d:\d\d  `+originalSHA[:7]+` Add feature 3\n$`, output)
+
+	// --undo needs a clean working directory when the branch is checked out
+	require.NoError(t, os.WriteFile(filepath.Join(repoPath, "feature1.txt"), []byte("dirty"), 0644))
+	err = rebranch.RunCmd([]string{"--undo"}, rebranch.Options{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "working directory is not clean")
+	runGit("checkout", "feature1.txt")
+
+	require.NoError(t, rebranch.RunCmd([]string{"--undo"}, rebranch.Options{}))
+	assert.Equal(t, originalSHA, revParse(t, repoPath, "feature"))
+	assert.FileExists(t, filepath.Join(repoPath, "feature2.txt"))
+	assert.NoFileExists(t, filepath.Join(repoPath, "main.txt"))
+	assert.Empty(t, runGit("for-each-ref", "refs/rebranch/"))
+
+	// A branch that is not checked out is moved without touching the checkout
+	require.NoError(t, rebranch.RunCmd([]string{"main"}, rebranch.Options{Editor: &MockEditor{}}))
+	require.NoError(t, rebranch.RunCmd([]string{"--done"}, rebranch.Options{}))
+	runGit("checkout", "main")
+	require.NoError(t, rebranch.RunCmd([]string{"--undo", "feature"}, rebranch.Options{}))
+	assert.Equal(t, originalSHA, revParse(t, repoPath, "feature"))
+	assert.Equal(t, "main", runGit("rev-parse", "--abbrev-ref", "HEAD"))
+}
+
+func TestBackupPruning(t *testing.T) {
+	repoPath, cleanup := setupRebranchTestRepo(t)
+	defer cleanup()
+
+	originalDir, err := os.Getwd()
+	require.NoError(t, err)
+	defer os.Chdir(originalDir)
+	require.NoError(t, os.Chdir(repoPath))
+
+	cmd := exec.Command("git", "config", "rebranch.keepBackups", "2")
+	cmd.Dir = repoPath
+	require.NoError(t, cmd.Run())
+
+	// Each round adds a commit to main and rebranches onto it
+	var tips []string
+	for i := 1; i <= 3; i++ {
+		tips = append(tips, revParse(t, repoPath, "feature"))
+		cmd = exec.Command("git", "checkout", "main")
+		cmd.Dir = repoPath
+		require.NoError(t, cmd.Run())
+		require.NoError(t, createCommitInRepo(repoPath, fmt.Sprintf("main%d.txt", i), "Main content", fmt.Sprintf("Main change %d", i)))
+		cmd = exec.Command("git", "checkout", "feature")
+		cmd.Dir = repoPath
+		require.NoError(t, cmd.Run())
+
+		require.NoError(t, rebranch.RunCmd([]string{"main"}, rebranch.Options{Editor: &MockEditor{}}))
+		require.NoError(t, rebranch.RunCmd([]string{"--done"}, rebranch.Options{}))
+	}
+
+	// Only the two newest backups are kept, and undo walks back through them
+	cmd = exec.Command("git", "for-each-ref", "--format=%(objectname)", "refs/rebranch/backup/feature/")
+	cmd.Dir = repoPath
+	output, err := cmd.Output()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, tips[1:], strings.Fields(string(output)))
+
+	require.NoError(t, rebranch.RunCmd([]string{"--undo"}, rebranch.Options{}))
+	assert.Equal(t, tips[2], revParse(t, repoPath, "feature"))
+	require.NoError(t, rebranch.RunCmd([]string{"--undo"}, rebranch.Options{}))
+	assert.Equal(t, tips[1], revParse(t, repoPath, "feature"))
+	err = rebranch.RunCmd([]string{"--undo"}, rebranch.Options{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "no backups of feature")
+}
+
+func TestDoneResumesAfterInterruption(t *testing.T) {
+	repoPath, cleanup := setupRebranchTestRepo(t)
+	defer cleanup()
+
+	originalDir, err := os.Getwd()
+	require.NoError(t, err)
+	defer os.Chdir(originalDir)
+	require.NoError(t, os.Chdir(repoPath))
+
+	runGit := func(args ...string) string {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = repoPath
+		output, err := cmd.Output()
+		require.NoError(t, err)
+		return strings.TrimSpace(string(output))
+	}
+
+	runGit("checkout", "main")
+	require.NoError(t, createCommitInRepo(repoPath, "main.txt", "Main content", "Main change"))
+	runGit("checkout", "feature")
+	oldSHA := revParse(t, repoPath, "feature")
+
+	require.NoError(t, rebranch.RunCmd([]string{"main"}, rebranch.Options{Editor: &MockEditor{}}))
+
+	store, err := rebranch.NewFileStoreInPath(repoPath)
+	require.NoError(t, err)
+	state, err := store.LoadState()
+	require.NoError(t, err)
+	newSHA := revParse(t, repoPath, state.TempBranch)
+
+	// Pretend --done crashed right after its ref transaction
+	state.Stage = "finishing"
+	state.SourceSHA = oldSHA
+	state.NewSHA = newSHA
+	state.BackupRef = "refs/rebranch/backup/feature/1700000000"
+	require.NoError(t, store.SaveState(state))
+	runGit("update-ref", "refs/heads/feature", newSHA, oldSHA)
+	runGit("update-ref", state.BackupRef, oldSHA, "")
+
+	err = rebranch.RunCmd([]string{"--abort"}, rebranch.Options{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "Run rebranch --done again")
+
+	require.NoError(t, rebranch.RunCmd([]string{"--done"}, rebranch.Options{}))
+
+	assert.False(t, store.StateExists())
+	assert.Equal(t, "feature", runGit("rev-parse", "--abbrev-ref", "HEAD"))
+	assert.Equal(t, newSHA, revParse(t, repoPath, "feature"))
+	assert.Equal(t, oldSHA, revParse(t, repoPath, state.BackupRef))
+	assert.Empty(t, runGit("branch", "--list", state.TempBranch))
+	assert.Empty(t, runGit("status", "--porcelain"))
+}
+
+func TestDoneRefusesMovedSource(t *testing.T) {
+	repoPath, cleanup := setupRebranchTestRepo(t)
+	defer cleanup()
+
+	originalDir, err := os.Getwd()
+	require.NoError(t, err)
+	defer os.Chdir(originalDir)
+	require.NoError(t, os.Chdir(repoPath))
+
+	require.NoError(t, rebranch.RunCmd([]string{"main"}, rebranch.Options{Editor: &MockEditor{}}))
+
+	store, err := rebranch.NewFileStoreInPath(repoPath)
+	require.NoError(t, err)
+	state, err := store.LoadState()
+	require.NoError(t, err)
+
+	// feature moves between recording the expected tips and the transaction
+	oldSHA := revParse(t, repoPath, "feature")
+	state.Stage = "finishing"
+	state.SourceSHA = revParse(t, repoPath, "feature~1")
+	state.NewSHA = revParse(t, repoPath, state.TempBranch)
+	state.BackupRef = "refs/rebranch/backup/feature/1700000000"
+	require.NoError(t, store.SaveState(state))
+
+	err = rebranch.RunCmd([]string{"--done"}, rebranch.Options{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "No branch was changed")
+
+	assert.Equal(t, oldSHA, revParse(t, repoPath, "feature"))
+	assert.True(t, store.StateExists())
+	cmd := exec.Command("git", "rev-parse", "--verify", "--quiet", state.BackupRef)
+	cmd.Dir = repoPath
+	assert.Error(t, cmd.Run())
+
+	// The failed transaction leaves the rebranch done, so it can be cancelled
+	state, err = store.LoadState()
+	require.NoError(t, err)
+	assert.Equal(t, "done", state.Stage)
+	require.NoError(t, rebranch.RunCmd([]string{"--abort"}, rebranch.Options{}))
+	assert.Equal(t, oldSHA, revParse(t, repoPath, "feature"))
+}
+
+func TestDoneRefusesMovedStackBranch(t *testing.T) {
+	repoPath, cleanup := setupRebranchTestRepo(t)
+	defer cleanup()
+
+	originalDir, err := os.Getwd()
+	require.NoError(t, err)
+	defer os.Chdir(originalDir)
+	require.NoError(t, os.Chdir(repoPath))
+
+	runGit := func(args ...string) {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = repoPath
+		require.NoError(t, cmd.Run())
+	}
+
+	runGit("branch", "part1", "feature~2")
+	runGit("checkout", "main")
+	require.NoError(t, createCommitInRepo(repoPath, "main.txt", "Main content", "Main branch work"))
+	runGit("checkout", "feature")
+
+	err = rebranch.RunCmd([]string{"--stack", "--worktree", "main"}, rebranch.Options{Editor: &MockEditor{}})
+	require.NoError(t, err)
+	store, err := rebranch.NewFileStoreInPath(repoPath)
+	require.NoError(t, err)
+	state, err := store.LoadState()
+	require.NoError(t, err)
+
+	// part1 moves after the rebranch started
+	runGit("update-ref", "refs/heads/part1", "feature~1")
+	err = rebranch.RunCmd([]string{"--done"}, rebranch.Options{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "stacked branch 'part1' moved")
+
+	// Nothing was touched, so the rebranch can still be cancelled
+	assert.DirExists(t, state.Worktree)
+	state, err = store.LoadState()
+	require.NoError(t, err)
+	assert.Equal(t, "done", state.Stage)
+	require.NoError(t, rebranch.RunCmd([]string{"--abort"}, rebranch.Options{}))
+	assert.Equal(t, revParse(t, repoPath, "feature~1"), revParse(t, repoPath, "part1"))
+	assert.False(t, store.StateExists())
+}
+
+func TestDonePreservesBranchConfig(t *testing.T) {
+	for _, args := range [][]string{{"main"}, {"--worktree", "main"}} {
+		t.Run(strings.Join(args, " "), func(t *testing.T) {
+			repoPath, cleanup := setupRebranchTestRepo(t)
+			defer cleanup()
+
+			originalDir, err := os.Getwd()
+			require.NoError(t, err)
+			defer os.Chdir(originalDir)
+			require.NoError(t, os.Chdir(repoPath))
+
+			runGit := func(args ...string) string {
+				cmd := exec.Command("git", args...)
+				cmd.Dir = repoPath
+				output, err := cmd.Output()
+				require.NoError(t, err)
+				return strings.TrimSpace(string(output))
+			}
+
+			// Upstream tracking, a description and an arbitrary per-branch key
+			runGit("config", "branch.feature.remote", "origin")
+			runGit("config", "branch.feature.merge", "refs/heads/feature")
+			runGit("config", "branch.feature.description", "Feature work\nspanning two lines")
+			runGit("config", "branch.feature.pushRemote", "fork")
+			before := runGit("config", "--get-regexp", `^branch\.feature\.`)
+
+			runGit("checkout", "main")
+			require.NoError(t, createCommitInRepo(repoPath, "main.txt", "Main content", "Main change"))
+			runGit("checkout", "feature")
+
+			require.NoError(t, rebranch.RunCmd(args, rebranch.Options{Editor: &MockEditor{}}))
+			require.NoError(t, rebranch.RunCmd([]string{"--done"}, rebranch.Options{}))
+
+			assert.Equal(t, before, runGit("config", "--get-regexp", `^branch\.feature\.`))
+			assert.Equal(t, "Feature work\nspanning two lines", runGit("config", "branch.feature.description"))
+			assert.NotContains(t, runGit("config", "--list"), rebranch.TempBranchPrefix)
+			assert.Equal(t, "Add feature 3\nAdd feature 2\nAdd feature 1", runGit("log", "--format=%s", "main..feature"))
+		})
+	}
+}
+
+func TestSourceMovedDuringRebranch(t *testing.T) {
+	repoPath, cleanup := setupRebranchTestRepo(t)
+	defer cleanup()
+
+	originalDir, err := os.Getwd()
+	require.NoError(t, err)
+	defer os.Chdir(originalDir)
+	require.NoError(t, os.Chdir(repoPath))
+
+	runGit := func(args ...string) string {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = repoPath
+		output, err := cmd.Output()
+		require.NoError(t, err)
+		return strings.TrimSpace(string(output))
+	}
+
+	runGit("checkout", "main")
+	require.NoError(t, createCommitInRepo(repoPath, "main.txt", "Main content", "Main change"))
+	runGit("checkout", "feature")
+	sourceSHA := revParse(t, repoPath, "feature")
+
+	// The checkout stays on feature, so work can go on while rebranching
+	require.NoError(t, rebranch.RunCmd([]string{"--worktree", "main"}, rebranch.Options{Editor: &MockEditor{}}))
+
+	store, err := rebranch.NewFileStoreInPath(repoPath)
+	require.NoError(t, err)
+	state, err := store.LoadState()
+	require.NoError(t, err)
+	assert.Equal(t, sourceSHA, state.SourceSHA)
+
+	// A rewritten source cannot be folded in
+	runGit("commit", "--amend", "-m", "Add feature 3, reworded")
+	err = rebranch.RunCmd([]string{"--fold-new"}, rebranch.Options{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "rewritten")
+	runGit("reset", "--hard", sourceSHA)
+
+	require.NoError(t, createCommitInRepo(repoPath, "feature4.txt", "Feature 4 content", "Add feature 4"))
+
+	err = rebranch.RunCmd([]string{"--done"}, rebranch.Options{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "moved since the rebranch started")
+	assert.Contains(t, err.Error(), "rebranch --fold-new")
+	assert.Equal(t, "Add feature 4", runGit("log", "-1", "--format=%s", "feature"))
+
+	output := captureStdout(t, func() {
+		require.NoError(t, rebranch.RunCmd([]string{"--status"}, rebranch.Options{}))
+	})
+	assert.Contains(t, output, "rebranch --fold-new")
+
+	require.NoError(t, rebranch.RunCmd([]string{"--fold-new"}, rebranch.Options{}))
+	state, err = store.LoadState()
+	require.NoError(t, err)
+	assert.Equal(t, "done", state.Stage)
+	assert.Equal(t, revParse(t, repoPath, "feature"), state.SourceSHA)
+
+	require.NoError(t, rebranch.RunCmd([]string{"--done"}, rebranch.Options{}))
+	assert.Equal(t, "Add feature 4\nAdd feature 3\nAdd feature 2\nAdd feature 1", runGit("log", "--format=%s", "main..feature"))
+}
+
+func TestStateFileVersionAndMigration(t *testing.T) {
+	repoPath, cleanup := setupRebranchTestRepo(t)
+	defer cleanup()
+
+	store, err := rebranch.NewFileStoreInPath(repoPath)
+	require.NoError(t, err)
+	statePath := filepath.Join(repoPath, ".git", rebranch.StateFileName)
+
+	// Saved states carry the current version and leave no temp files behind
+	require.NoError(t, store.SaveState(&rebranch.RebranchState{SourceBranch: "feature", Stage: "done"}))
+	data, err := os.ReadFile(statePath)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), fmt.Sprintf(`"version": %d`, rebranch.StateVersion))
+	leftovers, err := filepath.Glob(statePath + ".tmp-*")
+	require.NoError(t, err)
+	assert.Empty(t, leftovers)
+
+	// A state from before versioning has none of the later fields
+	old := `{"source_branch": "feature", "base_branch": "main", "temp_branch": "rebranch-temp-1",
+		"commits_to_apply": [{"sha": "abc1234", "message": "Add feature 1", "action": "pick"},
+			{"sha": "def5678", "message": "Add feature 2", "action": "drop"}],
+		"current_commit_idx": 0, "stage": "conflicts"}`
+	require.NoError(t, os.WriteFile(statePath, []byte(old), 0644))
+	state, err := store.LoadState()
+	require.NoError(t, err)
+	assert.Equal(t, rebranch.StateVersion, state.Version)
+	assert.Equal(t, "pick", state.CommitsToApply[0].Action)
+	assert.Equal(t, "drop", state.CommitsToApply[1].Action)
+	assert.Equal(t, "conflicts", state.Stage)
+	assert.Empty(t, state.SourceSHA)
+	assert.Empty(t, state.BaseSHA)
+
+	// A state from a newer rebranch is refused
+	require.NoError(t, os.WriteFile(statePath, []byte(`{"version": 99, "stage": "done"}`), 0644))
+	_, err = store.LoadState()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "newer rebranch")
+}
+
+func TestRepairCorruptState(t *testing.T) {
+	repoPath, cleanup := setupRebranchTestRepo(t)
+	defer cleanup()
+
+	originalDir, err := os.Getwd()
+	require.NoError(t, err)
+	defer os.Chdir(originalDir)
+	require.NoError(t, os.Chdir(repoPath))
+
+	cmd := exec.Command("git", "checkout", "main")
+	cmd.Dir = repoPath
+	require.NoError(t, cmd.Run())
+	require.NoError(t, createCommitInRepo(repoPath, "main.txt", "Main content", "Main change"))
+	cmd = exec.Command("git", "checkout", "feature")
+	cmd.Dir = repoPath
+	require.NoError(t, cmd.Run())
+
+	err = rebranch.RunCmd([]string{"--repair"}, rebranch.Options{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "no rebranch operation to repair")
+
+	require.NoError(t, rebranch.RunCmd([]string{"main"}, rebranch.Options{Editor: &MockEditor{}}))
+
+	store, err := rebranch.NewFileStoreInPath(repoPath)
+	require.NoError(t, err)
+	state, err := store.LoadState()
+	require.NoError(t, err)
+	tempBranch := state.TempBranch
+
+	// A write cut short by a crash
+	statePath := filepath.Join(repoPath, ".git", rebranch.StateFileName)
+	data, err := os.ReadFile(statePath)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(statePath, data[:len(data)/2], 0644))
+
+	err = rebranch.RunCmd([]string{"--status"}, rebranch.Options{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "rebranch --repair")
+
+	require.NoError(t, rebranch.RunCmd([]string{"--repair"}, rebranch.Options{}))
+	state, err = store.LoadState()
+	require.NoError(t, err)
+	assert.Equal(t, "feature", state.SourceBranch)
+	assert.Equal(t, tempBranch, state.TempBranch)
+	assert.Equal(t, "done", state.Stage)
+
+	// Repairing a readable state changes nothing
+	require.NoError(t, rebranch.RunCmd([]string{"--repair"}, rebranch.Options{}))
+
+	newSHA := revParse(t, repoPath, tempBranch)
+	require.NoError(t, rebranch.RunCmd([]string{"--done"}, rebranch.Options{}))
+	assert.Equal(t, newSHA, revParse(t, repoPath, "feature"))
+	assert.False(t, store.StateExists())
+}
+
+func TestLockContention(t *testing.T) {
+	repoPath, cleanup := setupRebranchTestRepo(t)
+	defer cleanup()
+
+	originalDir, err := os.Getwd()
+	require.NoError(t, err)
+	defer os.Chdir(originalDir)
+	require.NoError(t, os.Chdir(repoPath))
+
+	lockPath := filepath.Join(repoPath, ".git", rebranch.LockFileName)
+	hostname, err := os.Hostname()
+	require.NoError(t, err)
+	writeLock := func(pid int, host string) {
+		content := fmt.Sprintf(`{"pid": %d, "hostname": %q, "started": "2026-01-02T03:04:05Z"}`, pid, host)
+		require.NoError(t, os.WriteFile(lockPath, []byte(content), 0644))
+	}
+
+	// Only one of several concurrent lockers wins
+	const lockers = 8
+	results := make(chan error, lockers)
+	for i := 0; i < lockers; i++ {
+		go func() {
+			store, err := rebranch.NewFileStoreInPath(repoPath)
+			if err == nil {
+				err = store.Lock()
+			}
+			results <- err
+		}()
+	}
+	var acquired int
+	for i := 0; i < lockers; i++ {
+		if err := <-results; err == nil {
+			acquired++
+		} else {
+			assert.Contains(t, err.Error(), "another rebranch is running")
+		}
+	}
+	assert.Equal(t, 1, acquired)
+
+	store, err := rebranch.NewFileStoreInPath(repoPath)
+	require.NoError(t, err)
+	require.NoError(t, store.Unlock())
+	assert.NoFileExists(t, lockPath)
+
+	// A live holder blocks mutating commands but not --status
+	writeLock(os.Getpid(), hostname)
+	err = rebranch.RunCmd([]string{"main"}, rebranch.Options{Editor: &MockEditor{}})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), fmt.Sprintf("process %d on this host", os.Getpid()))
+	assert.Contains(t, err.Error(), "rm "+lockPath)
+	require.NoError(t, rebranch.RunCmd([]string{"--status"}, rebranch.Options{}))
+	assert.False(t, store.StateExists())
+
+	// A holder on another host cannot be checked, so it is never stale
+	writeLock(os.Getpid(), "elsewhere.example.com")
+	err = rebranch.RunCmd([]string{"--abort"}, rebranch.Options{})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "on elsewhere.example.com")
+
+	// A lock left by a process that has exited is removed
+	exited := exec.Command("true")
+	require.NoError(t, exited.Run())
+	writeLock(exited.Process.Pid, hostname)
+	require.NoError(t, rebranch.RunCmd([]string{"main"}, rebranch.Options{Editor: &MockEditor{}}))
+	assert.NoFileExists(t, lockPath)
+	assert.True(t, store.StateExists())
+}
+
+func TestStaleLockTakeoverRace(t *testing.T) {
+	repoPath, cleanup := setupRebranchTestRepo(t)
+	defer cleanup()
+
+	lockPath := filepath.Join(repoPath, ".git", rebranch.LockFileName)
+	hostname, err := os.Hostname()
+	require.NoError(t, err)
+	exited := exec.Command("true")
+	require.NoError(t, exited.Run())
+	staleLock := fmt.Sprintf(`{"pid": %d, "hostname": %q, "started": "2026-01-02T03:04:05Z"}`, exited.Process.Pid, hostname)
+
+	// Every locker finds the same stale lock; still only one may win
+	for round := 0; round < 20; round++ {
+		require.NoError(t, os.WriteFile(lockPath, []byte(staleLock), 0644))
+
+		const lockers = 8
+		start := make(chan struct{})
+		results := make(chan error, lockers)
+		for i := 0; i < lockers; i++ {
+			go func() {
+				store, err := rebranch.NewFileStoreInPath(repoPath)
+				if err == nil {
+					<-start
+					err = store.Lock()
+				}
+				results <- err
+			}()
+		}
+		close(start)
+
+		var acquired int
+		for i := 0; i < lockers; i++ {
+			if err := <-results; err == nil {
+				acquired++
+			} else {
+				assert.Contains(t, err.Error(), "another rebranch is running")
+			}
+		}
+		require.Equal(t, 1, acquired, "round %d", round)
+
+		store, err := rebranch.NewFileStoreInPath(repoPath)
+		require.NoError(t, err)
+		require.NoError(t, store.Unlock())
+	}
+}
+
+func TestLinkedWorktreeRebranch(t *testing.T) {
+	repoPath, cleanup := setupRebranchTestRepo(t)
+	defer cleanup()
+
+	originalDir, err := os.Getwd()
+	require.NoError(t, err)
+	defer os.Chdir(originalDir)
+
+	runGit := func(dir string, args ...string) string {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		output, err := cmd.Output()
+		require.NoError(t, err)
+		return strings.TrimSpace(string(output))
+	}
+
+	runGit(repoPath, "checkout", "main")
+	require.NoError(t, createCommitInRepo(repoPath, "main.txt", "Main content", "Main change"))
+	runGit(repoPath, "checkout", "feature")
+	wtPath := filepath.Join(t.TempDir(), "topic")
+	runGit(repoPath, "worktree", "add", "-b", "topic", wtPath, "feature")
+
+	// Stop the rebranch in the main checkout halfway
+	editor := &MockEditor{
+		ModifyFunc: func(filePath string) error {
+			data, err := os.ReadFile(filePath)
+			if err != nil {
+				return err
+			}
+			content := regexp.MustCompile(`(?m)^pick (\w+ Add feature 2)`).ReplaceAllString(string(data), "e $1")
+			return os.WriteFile(filePath, []byte(content), 0644)
+		},
+	}
+	require.NoError(t, os.Chdir(repoPath))
+	err = rebranch.RunCmd([]string{"main"}, rebranch.Options{Editor: editor})
+	require.NoError(t, err)
+
+	// A second rebranch in the linked worktree keeps its own state
+	require.NoError(t, os.Chdir(wtPath))
+	err = rebranch.RunCmd([]string{"main"}, rebranch.Options{Editor: &MockEditor{}})
+	require.NoError(t, err)
+
+	mainStore, err := rebranch.NewFileStoreInPath(repoPath)
+	require.NoError(t, err)
+	mainState, err := mainStore.LoadState()
+	require.NoError(t, err)
+	wtStore, err := rebranch.NewFileStoreInPath(wtPath)
+	require.NoError(t, err)
+	wtState, err := wtStore.LoadState()
+	require.NoError(t, err)
+
+	assert.Equal(t, "editing", mainState.Stage)
+	assert.Equal(t, "done", wtState.Stage)
+	assert.Equal(t, "topic", wtState.SourceBranch)
+	assert.NotEqual(t, mainState.TempBranch, wtState.TempBranch)
+	assert.FileExists(t, filepath.Join(repoPath, ".git", "worktrees", "topic", rebranch.StateFileName))
+
+	err = rebranch.RunCmd([]string{"--done"}, rebranch.Options{})
+	require.NoError(t, err)
+	assert.Equal(t, "Add feature 3\nAdd feature 2\nAdd feature 1", runGit(wtPath, "log", "--format=%s", "main..topic"))
+	assert.True(t, mainStore.StateExists())
+
+	// The main checkout's rebranch carries on undisturbed
+	require.NoError(t, os.Chdir(repoPath))
+	err = rebranch.RunCmd([]string{"--continue"}, rebranch.Options{Editor: editor})
+	require.NoError(t, err)
+	err = rebranch.RunCmd([]string{"--done"}, rebranch.Options{})
+	require.NoError(t, err)
+	assert.Equal(t, "Add feature 3\nAdd feature 2\nAdd feature 1", runGit(repoPath, "log", "--format=%s", "main..feature"))
+	assert.Equal(t, "topic", runGit(wtPath, "rev-parse", "--abbrev-ref", "HEAD"))
+}
+
+func TestSubmoduleRebranch(t *testing.T) {
+	repoPath, cleanup := setupRebranchTestRepo(t)
+	defer cleanup()
+
+	originalDir, err := os.Getwd()
+	require.NoError(t, err)
+	defer os.Chdir(originalDir)
+
+	runGit := func(dir string, args ...string) string {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		output, err := cmd.Output()
+		require.NoError(t, err)
+		return strings.TrimSpace(string(output))
+	}
+
+	runGit(repoPath, "checkout", "main")
+	require.NoError(t, createCommitInRepo(repoPath, "main.txt", "Main content", "Main change"))
+	runGit(repoPath, "checkout", "feature")
+
+	// A submodule's .git is a file pointing into the superproject's .git/modules
+	superPath := t.TempDir()
+	runGit(superPath, "init")
+	runGit(superPath, "-c", "protocol.file.allow=always", "submodule", "add", repoPath, "sub")
+	subPath := filepath.Join(superPath, "sub")
+	runGit(subPath, "config", "user.name", "Test User")
+	runGit(subPath, "config", "user.email", "test@example.com")
+	assert.Equal(t, "feature", runGit(subPath, "rev-parse", "--abbrev-ref", "HEAD"))
+
+	require.NoError(t, os.Chdir(subPath))
+	err = rebranch.RunCmd([]string{"origin/main"}, rebranch.Options{Editor: &MockEditor{}})
+	require.NoError(t, err)
+	assert.FileExists(t, filepath.Join(superPath, ".git", "modules", "sub", rebranch.StateFileName))
+
+	err = rebranch.RunCmd([]string{"--done"}, rebranch.Options{})
+	require.NoError(t, err)
+	assert.NoFileExists(t, filepath.Join(superPath, ".git", "modules", "sub", rebranch.StateFileName))
+	assert.Equal(t, "Add feature 3\nAdd feature 2\nAdd feature 1", runGit(subPath, "log", "--format=%s", "origin/main..feature"))
+}
+
+func TestGitDirEnvironment(t *testing.T) {
+	repoPath, cleanup := setupRebranchTestRepo(t)
+	defer cleanup()
+
+	originalDir, err := os.Getwd()
+	require.NoError(t, err)
+	defer os.Chdir(originalDir)
+
+	runGit := func(args ...string) string {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = repoPath
+		output, err := cmd.Output()
+		require.NoError(t, err)
+		return strings.TrimSpace(string(output))
+	}
+
+	runGit("checkout", "main")
+	require.NoError(t, createCommitInRepo(repoPath, "main.txt", "Main content", "Main change"))
+	runGit("checkout", "feature")
+
+	// Move the git directory out of the work tree and point git at it
+	gitDir := filepath.Join(t.TempDir(), "repo.git")
+	require.NoError(t, os.Rename(filepath.Join(repoPath, ".git"), gitDir))
+	t.Setenv("GIT_DIR", gitDir)
+	t.Setenv("GIT_WORK_TREE", repoPath)
+
+	require.NoError(t, os.Chdir(repoPath))
+	err = rebranch.RunCmd([]string{"main"}, rebranch.Options{Editor: &MockEditor{}})
+	require.NoError(t, err)
+	assert.FileExists(t, filepath.Join(gitDir, rebranch.StateFileName))
+	assert.NoDirExists(t, filepath.Join(repoPath, ".git"))
+
+	err = rebranch.RunCmd([]string{"--done"}, rebranch.Options{})
+	require.NoError(t, err)
+	assert.Equal(t, "Add feature 3\nAdd feature 2\nAdd feature 1", runGit("log", "--format=%s", "main..feature"))
+}
+
+func TestRunFromSubdirectory(t *testing.T) {
+	for _, worktree := range []bool{false, true} {
+		t.Run(fmt.Sprintf("worktree=%v", worktree), func(t *testing.T) {
+			repoPath, cleanup := setupRebranchTestRepo(t)
+			defer cleanup()
+
+			originalDir, err := os.Getwd()
+			require.NoError(t, err)
+			defer os.Chdir(originalDir)
+
+			runGit := func(args ...string) string {
+				cmd := exec.Command("git", args...)
+				cmd.Dir = repoPath
+				output, err := cmd.Output()
+				require.NoError(t, err)
+				return strings.TrimSpace(string(output))
+			}
+
+			// Both branches track a file in the nested directory, so checkouts
+			// never empty and remove it
+			subDir := filepath.Join(repoPath, "src", "pkg")
+			runGit("checkout", "main")
+			require.NoError(t, os.MkdirAll(subDir, 0755))
+			require.NoError(t, createCommitInRepo(repoPath, "src/pkg/common.txt", "Common content", "Add package"))
+			runGit("checkout", "feature")
+			runGit("rebase", "--quiet", "main")
+			require.NoError(t, createCommitInRepo(repoPath, "src/pkg/feature.txt", "Feature content", "Add nested feature"))
+			runGit("checkout", "main")
+			require.NoError(t, createCommitInRepo(repoPath, "src/pkg/main.txt", "Main content", "Main change"))
+			runGit("checkout", "feature")
+
+			require.NoError(t, os.Chdir(subDir))
+			args := []string{"--exec", "test -f initial.txt", "main"}
+			if worktree {
+				args = append([]string{"--worktree"}, args...)
+			}
+			err = rebranch.RunCmd(args, rebranch.Options{Editor: &MockEditor{}})
+			require.NoError(t, err)
+
+			store, err := rebranch.NewFileStore()
+			require.NoError(t, err)
+			state, err := store.LoadState()
+			require.NoError(t, err)
+			assert.Equal(t, "done", state.Stage)
+			assert.FileExists(t, filepath.Join(repoPath, ".git", rebranch.StateFileName))
+
+			output := captureStdout(t, func() {
+				require.NoError(t, rebranch.RunCmd([]string{"--status"}, rebranch.Options{}))
+			})
+			assert.Contains(t, output, "feature")
+
+			err = rebranch.RunCmd([]string{"--done"}, rebranch.Options{})
+			require.NoError(t, err)
+			assert.Equal(t, "Add nested feature\nAdd feature 3\nAdd feature 2\nAdd feature 1", runGit("log", "--format=%s", "main..feature"))
+			assert.FileExists(t, filepath.Join(subDir, "main.txt"))
+			assert.Empty(t, runGit("status", "--porcelain"))
+		})
+	}
+}
+
 func TestConflictResolution(t *testing.T) {
 	// Create repository with conflicting changes
 	tempDir, err := os.MkdirTemp("", "rebranch-conflict-test-*")
@@ -575,7 +2835,7 @@ d def1234 Second commit
 `
 	require.NoError(t, os.WriteFile(pickFile, []byte(modifiedContent), 0644))
 
-	parsedCommits, err := rebranch.ParseInteractiveFile(pickFile, commits)
+	parsedCommits, err := rebranch.ParseInteractiveFile(pickFile, commits, false)
 	require.NoError(t, err)
 	require.Len(t, parsedCommits, 2)
 
@@ -591,7 +2851,7 @@ drop def1234 Second commit
 `
 	require.NoError(t, os.WriteFile(pickFile, []byte(modifiedContentFull), 0644))
 
-	parsedCommits, err = rebranch.ParseInteractiveFile(pickFile, commits)
+	parsedCommits, err = rebranch.ParseInteractiveFile(pickFile, commits, false)
 	require.NoError(t, err)
 	require.Len(t, parsedCommits, 2)
 
@@ -606,9 +2866,68 @@ invalid abc1234 First commit
 `
 	require.NoError(t, os.WriteFile(pickFile, []byte(invalidContent), 0644))
 
-	_, err = rebranch.ParseInteractiveFile(pickFile, commits)
+	_, err = rebranch.ParseInteractiveFile(pickFile, commits, false)
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "invalid action 'invalid'")
+
+	// Test reordered lines are returned in file order
+	reorderedContent := `pick def1234 Second commit
+pick abc1234 First commit
+`
+	require.NoError(t, os.WriteFile(pickFile, []byte(reorderedContent), 0644))
+
+	parsedCommits, err = rebranch.ParseInteractiveFile(pickFile, commits, false)
+	require.NoError(t, err)
+	require.Len(t, parsedCommits, 2)
+	assert.Equal(t, "def1234567890", parsedCommits[0].SHA)
+	assert.Equal(t, "abc1234567890", parsedCommits[1].SHA)
+
+	// Test duplicate commits
+	duplicateContent := `pick abc1234 First commit
+pick def1234 Second commit
+pick abc1234 First commit
+`
+	require.NoError(t, os.WriteFile(pickFile, []byte(duplicateContent), 0644))
+
+	_, err = rebranch.ParseInteractiveFile(pickFile, commits, false)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "duplicate commit abc1234 on line 3 (already listed on line 1)")
+
+	// Test missing commits, with and without dropMissing
+	missingContent := `pick def1234 Second commit
+`
+	require.NoError(t, os.WriteFile(pickFile, []byte(missingContent), 0644))
+
+	_, err = rebranch.ParseInteractiveFile(pickFile, commits, false)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "commits missing from the pick file: abc1234")
+
+	parsedCommits, err = rebranch.ParseInteractiveFile(pickFile, commits, true)
+	require.NoError(t, err)
+	require.Len(t, parsedCommits, 1)
+	assert.Equal(t, "def1234567890", parsedCommits[0].SHA)
+
+	// Test history rewriting actions and their abbreviations
+	rewriteContent := `r abc1234 First commit
+squash def1234 Second commit
+`
+	require.NoError(t, os.WriteFile(pickFile, []byte(rewriteContent), 0644))
+
+	parsedCommits, err = rebranch.ParseInteractiveFile(pickFile, commits, false)
+	require.NoError(t, err)
+	require.Len(t, parsedCommits, 2)
+	assert.Equal(t, "reword", parsedCommits[0].Action)
+	assert.Equal(t, "squash", parsedCommits[1].Action)
+
+	// Test squash without a previous commit
+	squashFirstContent := `drop abc1234 First commit
+f def1234 Second commit
+`
+	require.NoError(t, os.WriteFile(pickFile, []byte(squashFirstContent), 0644))
+
+	_, err = rebranch.ParseInteractiveFile(pickFile, commits, false)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "cannot fixup on line 2 without a previous commit")
 }
 
 // MockEditor implements EditorInterface for testing
@@ -2,9 +2,11 @@ package rebranch
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"time"
 )
 
 // Store handles persistent state storage
@@ -13,50 +15,90 @@ type Store interface {
 	LoadState() (*RebranchState, error)
 	ClearState() error
 	StateExists() bool
+	Lock() error
+	Unlock() error
 }
 
 // FileStore implements Store using filesystem storage
 type FileStore struct {
 	stateFilePath string
+	lockFilePath  string
 }
 
-// NewFileStore creates a new Store
+// lockInfo identifies the process holding the lock file
+type lockInfo struct {
+	PID      int       `json:"pid"`
+	Hostname string    `json:"hostname"`
+	Started  time.Time `json:"started"`
+}
+
+// NewFileStore creates a new Store for the repository containing the current directory
 func NewFileStore() (Store, error) {
-	// Find .git directory
-	gitDir, err := findGitDir()
+	cwd, err := os.Getwd()
 	if err != nil {
-		return nil, fmt.Errorf("failed to find .git directory: %w", err)
+		return nil, fmt.Errorf("failed to get current directory: %w", err)
 	}
 
-	stateFilePath := filepath.Join(gitDir, StateFileName)
-	return &FileStore{
-		stateFilePath: stateFilePath,
-	}, nil
+	return NewFileStoreInPath(cwd)
 }
 
-// NewFileStoreInPath creates a new Store for a specific repository path
+// NewFileStoreInPath creates a new Store for the repository containing path. The
+// files live in the per-worktree git directory, so rebranches in different
+// worktrees of one repository do not collide.
 func NewFileStoreInPath(repoPath string) (Store, error) {
-	gitDir := filepath.Join(repoPath, ".git")
-	if _, err := os.Stat(gitDir); os.IsNotExist(err) {
+	_, gitDir, _, err := resolveRepository(repoPath)
+	if err != nil {
 		return nil, fmt.Errorf("not a git repository: %s", repoPath)
 	}
 
-	stateFilePath := filepath.Join(gitDir, StateFileName)
 	return &FileStore{
-		stateFilePath: stateFilePath,
+		stateFilePath: filepath.Join(gitDir, StateFileName),
+		lockFilePath:  filepath.Join(gitDir, LockFileName),
 	}, nil
 }
 
+// SaveState writes the state to a temp file and renames it over the state
+// file, so a crash or full disk leaves either the old or the new state behind,
+// never a truncated one
 func (f *FileStore) SaveState(state *RebranchState) error {
+	state.Version = StateVersion
 	data, err := json.MarshalIndent(state, "", "  ")
 	if err != nil {
 		return fmt.Errorf("failed to marshal state: %w", err)
 	}
 
-	err = os.WriteFile(f.stateFilePath, data, 0644)
+	dir := filepath.Dir(f.stateFilePath)
+	tmp, err := os.CreateTemp(dir, StateFileName+".tmp-*")
 	if err != nil {
 		return fmt.Errorf("failed to write state file: %w", err)
 	}
+	defer os.Remove(tmp.Name()) // No-op once renamed
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync state file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), f.stateFilePath); err != nil {
+		return fmt.Errorf("failed to replace state file: %w", err)
+	}
+
+	// Make the rename itself durable
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
 
 	return nil
 }
@@ -70,12 +112,35 @@ func (f *FileStore) LoadState() (*RebranchState, error) {
 	var state RebranchState
 	err = json.Unmarshal(data, &state)
 	if err != nil {
-		return nil, fmt.Errorf("failed to unmarshal state: %w", err)
+		return nil, fmt.Errorf("state file %s is corrupt: %v\n"+
+			"\n"+
+			"Rebuild it from the temp branch: rebranch --repair", f.stateFilePath, err)
+	}
+
+	if err := migrateState(&state); err != nil {
+		return nil, err
 	}
 
 	return &state, nil
 }
 
+// migrateState upgrades a state written by an older rebranch to StateVersion
+func migrateState(state *RebranchState) error {
+	// Files written before the version field existed hold a subset of the
+	// version 1 fields, so they are read as they are
+	if state.Version == 0 {
+		state.Version = 1
+	}
+
+	if state.Version > StateVersion {
+		return fmt.Errorf("state file was written by a newer rebranch (version %d, this one understands %d)\n"+
+			"\n"+
+			"Finish or abort the rebranch with that version", state.Version, StateVersion)
+	}
+
+	return nil
+}
+
 func (f *FileStore) ClearState() error {
 	if !f.StateExists() {
 		return nil // Nothing to clear
@@ -94,27 +159,106 @@ func (f *FileStore) StateExists() bool {
 	return err == nil
 }
 
-// findGitDir finds the .git directory starting from current directory
-func findGitDir() (string, error) {
-	currentDir, err := os.Getwd()
+// Lock takes the lock file, failing if another process holds it. A lock left
+// behind by a process that no longer runs on this host is removed.
+func (f *FileStore) Lock() error {
+	hostname, _ := os.Hostname()
+	info := lockInfo{PID: os.Getpid(), Hostname: hostname, Started: time.Now()}
+	data, err := json.Marshal(info)
 	if err != nil {
-		return "", err
+		return fmt.Errorf("failed to marshal lock: %w", err)
 	}
 
-	// Walk up the directory tree looking for .git
-	for {
-		gitDir := filepath.Join(currentDir, ".git")
-		if _, err := os.Stat(gitDir); err == nil {
-			return gitDir, nil
+	for attempt := 0; ; attempt++ {
+		// O_EXCL makes creating the file the atomic test-and-set
+		file, err := os.OpenFile(f.lockFilePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			_, writeErr := file.Write(data)
+			closeErr := file.Close()
+			if writeErr != nil || closeErr != nil {
+				os.Remove(f.lockFilePath)
+				return fmt.Errorf("failed to write lock file: %v", errors.Join(writeErr, closeErr))
+			}
+			return nil
+		}
+		if !os.IsExist(err) {
+			return fmt.Errorf("failed to create lock file: %w", err)
 		}
 
-		parent := filepath.Dir(currentDir)
-		if parent == currentDir {
-			// Reached root directory
-			break
+		holder, stale := f.readLock(hostname)
+		if !stale || attempt > 0 {
+			return lockHeldError(f.lockFilePath, holder, hostname)
+		}
+		if err := f.removeStaleLock(hostname); err != nil {
+			return err
 		}
-		currentDir = parent
 	}
+}
+
+// removeStaleLock removes the lock file if its holder is gone. Processes that
+// found the same stale lock take turns, and each checks it again first, so a
+// lock just taken by one of them is never removed by another.
+func (f *FileStore) removeStaleLock(hostname string) error {
+	unlock, err := lockTakeover(filepath.Dir(f.lockFilePath))
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	holder, stale := f.readLock(hostname)
+	if !stale || holder == nil {
+		return nil
+	}
+	fmt.Printf("Removing stale lock left by process %d\n", holder.PID)
+	if err := os.Remove(f.lockFilePath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove stale lock file: %w", err)
+	}
+	return nil
+}
+
+// Unlock releases the lock file
+func (f *FileStore) Unlock() error {
+	if err := os.Remove(f.lockFilePath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove lock file: %w", err)
+	}
+	return nil
+}
 
-	return "", fmt.Errorf(".git directory not found")
+// readLock returns who holds the lock file and whether that process is known
+// to be gone. A lock from another host, or one still being written, is never
+// considered stale.
+func (f *FileStore) readLock(hostname string) (*lockInfo, bool) {
+	data, err := os.ReadFile(f.lockFilePath)
+	if err != nil {
+		return nil, os.IsNotExist(err)
+	}
+
+	var holder lockInfo
+	if err := json.Unmarshal(data, &holder); err != nil || holder.PID <= 0 {
+		return nil, false
+	}
+	if holder.Hostname != hostname {
+		return &holder, false
+	}
+
+	return &holder, !processRunning(holder.PID)
+}
+
+// lockHeldError explains which process holds the lock and how to clear it
+func lockHeldError(path string, holder *lockInfo, hostname string) error {
+	if holder == nil {
+		return fmt.Errorf("another rebranch is running (lock file %s)\n"+
+			"\n"+
+			"Wait for it to finish. If no rebranch is running, remove the lock:\n"+
+			"  rm %s", path, path)
+	}
+
+	where := "on this host"
+	if holder.Hostname != hostname {
+		where = "on " + holder.Hostname
+	}
+	return fmt.Errorf("another rebranch is running (process %d %s, since %s)\n"+
+		"\n"+
+		"Wait for it to finish. If no rebranch is running %s, remove the lock:\n"+
+		"  rm %s", holder.PID, where, holder.Started.Format("2006-01-02 15:04:05"), where, path)
 }
@@ -0,0 +1,17 @@
+//go:build !unix
+
+package rebranch
+
+// processRunning cannot tell a finished process from a running one on this
+// platform, so it assumes the lock holder is still running. A lock left by a
+// crash has to be removed by hand.
+func processRunning(pid int) bool {
+	return true
+}
+
+// lockTakeover serializes stale lock removal between processes. processRunning
+// never reports a holder gone on this platform, so no lock is found stale and
+// there is nothing to serialize.
+func lockTakeover(dir string) (func(), error) {
+	return func() {}, nil
+}
@@ -0,0 +1,35 @@
+//go:build unix
+
+package rebranch
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// processRunning reports whether a process with pid exists on this host
+func processRunning(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	// Signal 0 only checks that the process exists
+	err = process.Signal(syscall.Signal(0))
+	return !errors.Is(err, os.ErrProcessDone)
+}
+
+// lockTakeover serializes stale lock removal between processes by locking
+// dir. The kernel drops the lock if the process dies, so it cannot go stale.
+func lockTakeover(dir string) (func(), error) {
+	file, err := os.Open(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", dir, err)
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to lock %s: %w", dir, err)
+	}
+	return func() { file.Close() }, nil
+}
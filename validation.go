@@ -5,8 +5,9 @@ import (
 	"fmt"
 )
 
-// validateStart performs pre-flight checks before starting a rebranch operation
-func validateStart(baseBranch string, git GitInterface, state Store) error {
+// validateStart performs pre-flight checks before starting a rebranch operation.
+// upstream is only set with --onto.
+func validateStart(baseBranch, upstream string, git GitInterface, state Store) error {
 	// Check if repository is valid
 	if err := git.IsValidRepository(); err != nil {
 		return fmt.Errorf("invalid repository: %w", err)
@@ -19,7 +20,8 @@ func validateStart(baseBranch string, git GitInterface, state Store) error {
 			"Available actions:\n" +
 			"  • Continue: rebranch --continue (after resolving conflicts)\n" +
 			"  • Complete: rebranch --done (if cherry-picking finished)\n" +
-			"  • Cancel: rebranch --abort (revert to original state)")
+			"  • Cancel: rebranch --abort (revert to original state)\n" +
+			"  • Unreadable state file: rebranch --repair")
 	}
 
 	// Check for other ongoing git operations
@@ -50,16 +52,46 @@ func validateStart(baseBranch string, git GitInterface, state Store) error {
 			"  • Check status: git status")
 	}
 
-	// Check if base branch exists
-	if !git.BranchExists(baseBranch) {
+	return validateBase(baseBranch, upstream, git)
+}
+
+// validateDryRun performs the checks a dry run needs; it never touches the
+// working tree, so uncommitted changes and other operations do not matter
+func validateDryRun(baseBranch, upstream string, git GitInterface) error {
+	// Check if repository is valid
+	if err := git.IsValidRepository(); err != nil {
+		return fmt.Errorf("invalid repository: %w", err)
+	}
+
+	return validateBase(baseBranch, upstream, git)
+}
+
+// validateBase checks that the base and --onto upstream resolve and that the
+// current branch is not the base
+func validateBase(baseBranch, upstream string, git GitInterface) error {
+	// Check if base resolves to a commit (branch, remote branch, tag or SHA)
+	if _, err := git.ResolveRevision(baseBranch); err != nil {
 		return fmt.Errorf("base branch '%s' does not exist\n"+
 			"\n"+
 			"Suggestions:\n"+
 			"  • Check branch name spelling\n"+
 			"  • Run 'git branch -a' to see all available branches\n"+
+			"  • Fetch remote branches: git fetch\n"+
 			"  • Create the branch: git checkout -b %s", baseBranch, baseBranch)
 	}
 
+	// Check if the --onto upstream resolves to a commit
+	if upstream != "" {
+		if _, err := git.ResolveRevision(upstream); err != nil {
+			return fmt.Errorf("upstream '%s' does not exist\n"+
+				"\n"+
+				"Suggestions:\n"+
+				"  • Check branch name spelling\n"+
+				"  • Run 'git branch -a' to see all available branches\n"+
+				"  • Use the branch or commit your current branch was created from", upstream)
+		}
+	}
+
 	// Get current branch
 	currentBranch, err := git.GetCurrentBranch()
 	if err != nil {
@@ -97,9 +129,28 @@ func validateContinue(git GitInterface, state Store) error {
 		return fmt.Errorf("failed to load rebranch state: %w", err)
 	}
 
-	// Only allow continue if we're in conflicts stage
-	if rebranchState.Stage != "conflicts" {
-		return fmt.Errorf("rebranch is not waiting for conflict resolution (current stage: %s)", rebranchState.Stage)
+	// Only allow continue if we're stopped for conflicts, an edit, a failed exec
+	// or a failed message
+	switch rebranchState.Stage {
+	case "conflicts", "editing", "exec-failed", "message-failed":
+	default:
+		return fmt.Errorf("rebranch is not stopped for conflicts, an edit, a failed exec or a failed message (current stage: %s)", rebranchState.Stage)
+	}
+
+	// Commits added to the source meanwhile would be lost
+	if err := validateSourceUnchanged(git, rebranchState); err != nil {
+		return err
+	}
+
+	// The commits may be applied in a separate worktree
+	git, err = worktreeGit(git, rebranchState)
+	if err != nil {
+		return err
+	}
+
+	// A cherry-pick or merge stopped by conflicts is committed by continue itself
+	if rebranchState.Stage == "conflicts" && git.PendingCommit() != "" {
+		return nil
 	}
 
 	// Check if working directory is clean (conflicts should be resolved)
@@ -108,7 +159,33 @@ func validateContinue(git GitInterface, state Store) error {
 		return fmt.Errorf("failed to check working directory status: %w", err)
 	}
 	if !isClean {
-		return errors.New("working directory is not clean. Please resolve conflicts and stage changes before continuing")
+		return errors.New("working directory is not clean. Please resolve conflicts or amend and commit your changes before continuing")
+	}
+
+	return nil
+}
+
+// validateSkip performs checks before skipping the conflicting commit
+func validateSkip(git GitInterface, state Store) error {
+	// Check if repository is valid
+	if err := git.IsValidRepository(); err != nil {
+		return fmt.Errorf("invalid repository: %w", err)
+	}
+
+	// Check if there's a rebranch operation in progress
+	if !state.StateExists() {
+		return errors.New("no rebranch operation in progress")
+	}
+
+	// Load state to check stage
+	rebranchState, err := state.LoadState()
+	if err != nil {
+		return fmt.Errorf("failed to load rebranch state: %w", err)
+	}
+
+	// Only a conflicting commit, or one whose message failed, can be skipped
+	if rebranchState.Stage != "conflicts" && rebranchState.Stage != "message-failed" {
+		return fmt.Errorf("rebranch is not stopped for conflicts (current stage: %s)", rebranchState.Stage)
 	}
 
 	return nil
@@ -132,11 +209,32 @@ func validateFinish(git GitInterface, state Store) error {
 		return fmt.Errorf("failed to load rebranch state: %w", err)
 	}
 
+	// An interrupted --done is resumed from where it stopped
+	if rebranchState.Stage == "finishing" {
+		return nil
+	}
+
 	// Only allow finish if we're in done stage
 	if rebranchState.Stage != "done" {
 		return fmt.Errorf("rebranch is not ready to finish (current stage: %s). Run rebranch --continue first", rebranchState.Stage)
 	}
 
+	// Commits added to the source meanwhile would be lost
+	if err := validateSourceUnchanged(git, rebranchState); err != nil {
+		return err
+	}
+
+	// --done moves the stacked branches in the same transaction as the source
+	if err := validateStackUnchanged(git, rebranchState); err != nil {
+		return err
+	}
+
+	// The commits may be applied in a separate worktree
+	git, err = worktreeGit(git, rebranchState)
+	if err != nil {
+		return err
+	}
+
 	// Verify we're on the temp branch
 	currentBranch, err := git.GetCurrentBranch()
 	if err != nil {
@@ -171,5 +269,136 @@ func validateAbort(git GitInterface, state Store) error {
 		return errors.New("no rebranch operation in progress")
 	}
 
+	// Once --done has moved the refs it can only be completed
+	rebranchState, err := state.LoadState()
+	if err != nil {
+		return fmt.Errorf("failed to load rebranch state: %w", err)
+	}
+	if rebranchState.Stage == "finishing" && refsReplaced(git, rebranchState) {
+		return errors.New("rebranch --done was interrupted and cannot be aborted\n" +
+			"\n" +
+			"Run rebranch --done again to finish replacing the branch")
+	}
+
+	return nil
+}
+
+// validateUndo performs checks before restoring a backup of branch
+func validateUndo(branch string, git GitInterface, state Store) error {
+	// Check if repository is valid
+	if err := git.IsValidRepository(); err != nil {
+		return fmt.Errorf("invalid repository: %w", err)
+	}
+
+	// Undoing underneath a running rebranch would confuse --done
+	if state.StateExists() {
+		return errors.New("rebranch operation in progress\n" +
+			"\n" +
+			"Finish it with rebranch --done or cancel it with rebranch --abort first")
+	}
+
+	// Restoring the checked-out branch resets the working directory
+	currentBranch, err := git.GetCurrentBranch()
+	if err != nil || currentBranch != branch {
+		return nil
+	}
+	isClean, err := git.IsCleanWorkingDirectory()
+	if err != nil {
+		return fmt.Errorf("failed to check working directory status: %w", err)
+	}
+	if !isClean {
+		return errors.New("working directory is not clean\n" +
+			"\n" +
+			"Please resolve before undoing:\n" +
+			"  • Commit changes: git add . && git commit -m \"Your message\"\n" +
+			"  • Or stash changes: git stash\n" +
+			"  • Check status: git status")
+	}
+
+	return nil
+}
+
+// validateStackUnchanged checks that every stacked branch was reached in the
+// pick list and still points at the commit it pointed at when the rebranch started
+func validateStackUnchanged(git GitInterface, state *RebranchState) error {
+	for _, branch := range state.StackBranches {
+		if branch.NewSHA == "" {
+			return fmt.Errorf("stacked branch %s was never reached in the pick list\n"+
+				"\n"+
+				"Cancel rebranch with rebranch --abort and start again", branch.Name)
+		}
+
+		current, err := git.ResolveRevision("refs/heads/" + branch.Name)
+		if err != nil {
+			return fmt.Errorf("stacked branch '%s' no longer exists\n"+
+				"\n"+
+				"Suggestions:\n"+
+				"  • Recreate it where it was: git branch %s %s\n"+
+				"  • Or cancel rebranch: rebranch --abort", branch.Name, branch.Name, branch.OldSHA)
+		}
+		if current != branch.OldSHA {
+			return fmt.Errorf("stacked branch '%s' moved since the rebranch started (%s, now %s)\n"+
+				"\n"+
+				"Replacing it now would lose the new commits. Either:\n"+
+				"  • Move it back: git update-ref refs/heads/%s %s\n"+
+				"  • Or cancel rebranch: rebranch --abort", branch.Name, shortSHA(branch.OldSHA), shortSHA(current), branch.Name, branch.OldSHA)
+		}
+	}
+	return nil
+}
+
+// validateSourceUnchanged checks that the source branch still points at the
+// commit the rebranch started from
+func validateSourceUnchanged(git GitInterface, state *RebranchState) error {
+	// Rebranches started before the source was pinned cannot be checked
+	if state.SourceSHA == "" {
+		return nil
+	}
+
+	current, err := git.ResolveRevision("refs/heads/" + state.SourceBranch)
+	if err != nil {
+		return fmt.Errorf("source branch '%s' no longer exists\n"+
+			"\n"+
+			"Suggestions:\n"+
+			"  • Recreate it where it was: git branch %s %s\n"+
+			"  • Or cancel rebranch: rebranch --abort", state.SourceBranch, state.SourceBranch, state.SourceSHA)
+	}
+	if current == state.SourceSHA {
+		return nil
+	}
+
+	return fmt.Errorf("source branch '%s' moved since the rebranch started (%s, now %s)\n"+
+		"\n"+
+		"Replacing it now would lose the new commits. Either:\n"+
+		"  • Add them to the end of the pick list: rebranch --fold-new\n"+
+		"  • Or cancel rebranch: rebranch --abort", state.SourceBranch, shortSHA(state.SourceSHA), shortSHA(current))
+}
+
+// validateFoldNew performs checks before folding new source commits into the
+// pick list
+func validateFoldNew(git GitInterface, state Store) error {
+	// Check if repository is valid
+	if err := git.IsValidRepository(); err != nil {
+		return fmt.Errorf("invalid repository: %w", err)
+	}
+
+	// Check if there's a rebranch operation in progress
+	if !state.StateExists() {
+		return errors.New("no rebranch operation in progress")
+	}
+
+	// Load state to check stage
+	rebranchState, err := state.LoadState()
+	if err != nil {
+		return fmt.Errorf("failed to load rebranch state: %w", err)
+	}
+
+	// Commits can be added whenever the rebranch is stopped
+	switch rebranchState.Stage {
+	case "conflicts", "editing", "exec-failed", "message-failed", "done":
+	default:
+		return fmt.Errorf("rebranch is not stopped (current stage: %s)", rebranchState.Stage)
+	}
+
 	return nil
 }